@@ -31,7 +31,7 @@ var (
 	options = []sensu.ConfigOption{
 		&sensu.PluginConfigOption[string]{
 			Path:      "airflow-api-url",
-			Env:       "",
+			Env:       "AIRFLOW_API_URL",
 			Argument:  "url",
 			Shorthand: "u",
 			Default:   "http://127.0.0.1:8080/",
@@ -56,18 +56,22 @@ func main() {
 }
 
 func checkArgs(event *corev2.Event) (int, error) {
-	_, err := url.Parse(plugin.AirflowApiUrl)
+	apiUrl, err := url.Parse(plugin.AirflowApiUrl)
 	if err != nil {
 		return sensu.CheckStateWarning, fmt.Errorf("failed to parse airflow URL %s: %v", plugin.AirflowApiUrl, err)
+	} else if apiUrl.Scheme != "http" && apiUrl.Scheme != "https" {
+		return sensu.CheckStateWarning, fmt.Errorf("airflow URL %s must start with http:// or https://", plugin.AirflowApiUrl)
+	} else if apiUrl.Host == "" {
+		return sensu.CheckStateWarning, fmt.Errorf("airflow URL %s must include a host", plugin.AirflowApiUrl)
 	}
 
 	return sensu.CheckStateOK, nil
 }
 
 func executeCheck(event *corev2.Event) (int, error) {
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
+	client := &http.Client{
+		Timeout: time.Duration(plugin.Timeout) * time.Second,
+	}
 
 	critical := false
 	var err error
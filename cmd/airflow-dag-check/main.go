@@ -1,27 +1,183 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	corev2 "github.com/sensu/core/v2"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"gopkg.in/yaml.v2"
 )
 
 // Config represents the check plugin config.
 type Config struct {
 	sensu.PluginConfig
-	AirflowApiUrl   string
-	AirflowUsername string
-	AirflowPassword string
-	Dags            []string
-	Timeout         int
+	AirflowApiUrl      string
+	AirflowApiUrls     []string
+	GraphqlUrl         string
+	GraphqlCredentials bool
+	InstancePrefix     string
+	ApiVersion         string
+	AirflowUsername    string
+	AirflowPassword    string
+	AirflowUsernames   []string
+	AirflowPasswords   []string
+	PasswordFile       string
+	ConfigFile         string
+	Token              string
+	NoAuth             bool
+	Dags               []string
+	DagRunId           string
+	Tags               []string
+	ExcludeDags        []string
+	OnlyActive         bool
+	WarnOnPaused       bool
+	WarnOnNoSchedule   bool
+	DagRegex           []string
+	ExcludeRegex       []string
+	WarnCatchup        []string
+	RequiredTags       []string
+	MinSuccessRate     int
+	WaitCompletion     bool
+	WaitTimeout        int
+	PollInterval       int
+	Output             string
+	PerDagTimeout      int
+	MaxTotalRequests   int
+	WarnNoRuns         bool
+	RequireRuns        bool
+	MinRuns            int
+	RedactDagIds       bool
+	RedactMapFile      string
+	AnyFailedWithin    int
+	LatestPerType      bool
+	SkipActiveRuns     bool
+	HistoryLimit       int
+	Heartbeat          bool
+	StateFile          string
+	DetectStalled      bool
+	AlertNewFailures   bool
+	AllUnknownState    string
+	MaxIntervalLag     int
+	CheckZombies       bool
+	CheckTasks         bool
+	CheckSla           bool
+	Pool               string
+	MinRunsPerMinute   float64
+	RunRateWindow      int
+	ExpectOrder        []string
+	MaxTaskQueuedAge   int
+	MaxRetries         int
+	AuthFailureState   string
+	ExpectTaskCount    map[string]int
+	TaskCountTolerance int
+	MaintenanceAware   bool
+	MaintenanceState   string
+	MaintenanceWindow  string
+	ManifestFile       string
+	UntrackedState     string
+	UndeployedState    string
+	IncludeLogs        bool
+	LogBytes           int
+	DimensionWeights   map[string]int
+	TrendFile          string
+	TrendWindow        int
+	TextfilePath       string
+	InsecureSkipVerify bool
+	FollowRedirects    bool
+	MaxIdleConns       int
+	DisableKeepAlives  bool
+	VerifyEndpoint     bool
+	CACert             string
+	ClientCert         string
+	ClientKey          string
+	Proxy              string
+	Headers            []string
+	AcceptHeader       string
+	OkStatusCodes      []int
+	FailureThreshold   int
+	CriticalPercent    int
+	WarningPercent     int
+	MaxRunDuration     int
+	MaxAge             int
+	Since              int
+	CheckHealth        bool
+	CheckImportErrors  bool
+	CheckConnections   []string
+	CheckDatasets      []string
+	DatasetMaxAge      int
+	PoolChecks         []string
+	PoolMinSlots       int
+	Retries            int
+	RetryDelay         int
+	Perfdata           bool
+	Verbose            bool
+	Debug              bool
+	Timings            bool
+	SummaryOnly        bool
+	QuietOk            bool
+	SummaryLine        bool
+	FailFast           bool
+	ListDags           bool
+	MinDagCount        int
+	MaxDags            int
+	NoDagsStatus       string
+	NotFoundState      string
+	PausedState        string
+	DagSeverity        map[string]string
+	TagSeverity        map[string]string
+	OkStates           []string
+	FailStates         []string
+	DagOkStates        []string
+	DowngradeFailures  bool
+	RunConfMatch       map[string]string
+	Timeout            int
+
+	// parsed from the options above by checkArgs
+	customHeaders   http.Header
+	rootCAs         *x509.CertPool
+	clientCerts     []tls.Certificate
+	dagPatterns     []*regexp.Regexp
+	excludePatterns []*regexp.Regexp
+	okStatesByDag   map[string][]string
+}
+
+const (
+	outputText        = "text"
+	outputCheckResult = "check-result"
+	outputOpenMetrics = "openmetrics"
+	outputJSON        = "json"
+)
+
+// checkStates maps the state names accepted by options to check states.
+var checkStates = map[string]int{
+	"ok":       sensu.CheckStateOK,
+	"warning":  sensu.CheckStateWarning,
+	"critical": sensu.CheckStateCritical,
+	"unknown":  sensu.CheckStateUnknown,
 }
 
+var checkStateNames = []string{"ok", "warning", "critical", "unknown"}
+
 var (
 	plugin = Config{
 		PluginConfig: sensu.PluginConfig{
@@ -34,16 +190,154 @@ var (
 	options = []sensu.ConfigOption{
 		&sensu.PluginConfigOption[string]{
 			Path:      "airflow-api-url",
-			Env:       "",
+			Env:       "AIRFLOW_API_URL",
 			Argument:  "url",
 			Shorthand: "u",
 			Default:   "http://127.0.0.1:8080/",
 			Usage:     "The base URL of the airflow REST API.",
 			Value:     &plugin.AirflowApiUrl,
 		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "airflow-api-urls",
+			Env:      "",
+			Argument: "urls",
+			Default:  []string{},
+			Usage:    "Base URLs of several airflow instances to check in turn instead of --url, comma separated or repeated.",
+			Value:    &plugin.AirflowApiUrls,
+		},
 		&sensu.PluginConfigOption[string]{
-			Path:      "airflow-username",
+			Path:     "graphql-url",
+			Env:      "",
+			Argument: "graphql-url",
+			Default:  "",
+			Usage:    "GraphQL endpoint retrieving the checked DAGs and their latest run in a single query, the REST API retrieving whatever the query fails to return.",
+			Value:    &plugin.GraphqlUrl,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "graphql-credentials",
+			Env:      "",
+			Argument: "graphql-credentials",
+			Default:  false,
+			Usage:    "Send the credentials and --header headers to a --graphql-url on another host than the airflow API.",
+			Value:    &plugin.GraphqlCredentials,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:      "insecure-skip-verify",
 			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "k",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification of the airflow API. This disables certificate validation and should only be used for testing.",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "ca-cert",
+			Env:      "",
+			Argument: "ca-cert",
+			Default:  "",
+			Usage:    "Path to a PEM encoded CA bundle used to verify the airflow API certificate. Ignored with --insecure-skip-verify.",
+			Value:    &plugin.CACert,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "client-cert",
+			Env:      "",
+			Argument: "client-cert",
+			Default:  "",
+			Usage:    "Path to a PEM encoded client certificate presented to the airflow API, requires --client-key.",
+			Value:    &plugin.ClientCert,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "client-key",
+			Env:      "",
+			Argument: "client-key",
+			Default:  "",
+			Usage:    "Path to the PEM encoded private key of --client-cert.",
+			Value:    &plugin.ClientKey,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "proxy",
+			Env:      "",
+			Argument: "proxy",
+			Default:  "",
+			Usage:    "URL of the proxy used to reach the airflow API, overriding the HTTP_PROXY and HTTPS_PROXY environment variables.",
+			Value:    &plugin.Proxy,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "follow-redirects",
+			Env:      "",
+			Argument: "follow-redirects",
+			Default:  false,
+			Usage:    "Follow HTTP redirects of the airflow API. The credentials are only sent again to the same host.",
+			Value:    &plugin.FollowRedirects,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-idle-conns",
+			Env:      "",
+			Argument: "max-idle-conns",
+			Default:  0,
+			Usage:    "Maximum number of idle connections kept open to the airflow API, 0 for the Go defaults.",
+			Value:    &plugin.MaxIdleConns,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "disable-keepalives",
+			Env:      "",
+			Argument: "disable-keepalives",
+			Default:  false,
+			Usage:    "Open a new connection to the airflow API for each request.",
+			Value:    &plugin.DisableKeepAlives,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "verify-endpoint",
+			Env:      "",
+			Argument: "verify-endpoint",
+			Default:  false,
+			Usage:    "Returns critical if the version endpoint of the API does not report an airflow version, e.g. for a wrong URL or API version.",
+			Value:    &plugin.VerifyEndpoint,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "header",
+			Env:                 "",
+			Argument:            "header",
+			Default:             []string{},
+			Usage:               "Additional header sent with every request, as \"Name: Value\", can be repeated.",
+			Value:               &plugin.Headers,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "accept-header",
+			Env:      "",
+			Argument: "accept-header",
+			Default:  "application/json",
+			Usage:    "Accept header of the API requests, for airflow releases expecting a specific media type.",
+			Value:    &plugin.AcceptHeader,
+		},
+		&sensu.SlicePluginConfigOption[int]{
+			Path:     "ok-status-codes",
+			Env:      "",
+			Argument: "ok-status-codes",
+			Default:  []int{200},
+			Usage:    "HTTP status codes of a successful API response, comma separated. The listed codes other than 200 may come with an empty body, and unlisted codes outside 2xx are errors.",
+			Value:    &plugin.OkStatusCodes,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "api-version",
+			Env:      "",
+			Argument: "api-version",
+			Default:  "v1",
+			Usage:    "Version of the airflow REST API, used to build its path as /api/<version>.",
+			Value:    &plugin.ApiVersion,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "instance-prefix",
+			Env:      "",
+			Argument: "instance-prefix",
+			Default:  "",
+			Usage:    "Path prefix of the airflow instance, prepended to the API path (e.g. team-a/airflow).",
+			Value:    &plugin.InstancePrefix,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "airflow-username",
+			Env:       "AIRFLOW_USERNAME",
 			Argument:  "username",
 			Shorthand: "n",
 			Default:   "",
@@ -52,13 +346,61 @@ var (
 		},
 		&sensu.PluginConfigOption[string]{
 			Path:      "airflow-password",
-			Env:       "",
+			Env:       "AIRFLOW_PASSWORD",
 			Argument:  "password",
 			Shorthand: "p",
 			Default:   "",
 			Usage:     "The password used to authenticate against the airflow API.",
 			Value:     &plugin.AirflowPassword,
 		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "airflow-usernames",
+			Env:      "",
+			Argument: "usernames",
+			Default:  []string{},
+			Usage:    "Usernames of the instances given with --urls, in the same order. Defaults to --username for all instances.",
+			Value:    &plugin.AirflowUsernames,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "airflow-passwords",
+			Env:      "",
+			Argument: "passwords",
+			Default:  []string{},
+			Usage:    "Passwords of the instances given with --urls, in the same order. Defaults to --password for all instances.",
+			Value:    &plugin.AirflowPasswords,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "password-file",
+			Env:      "",
+			Argument: "password-file",
+			Default:  "",
+			Usage:    "File containing the password used to authenticate against the airflow API.",
+			Value:    &plugin.PasswordFile,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "config-file",
+			Env:      "",
+			Argument: "config-file",
+			Default:  "",
+			Usage:    "YAML or JSON file of options keyed by their flag name. Flags given on the command line override it.",
+			Value:    &plugin.ConfigFile,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "token",
+			Env:      "AIRFLOW_TOKEN",
+			Argument: "token",
+			Default:  "",
+			Usage:    "Bearer token used to authenticate against the airflow API instead of the username and password.",
+			Value:    &plugin.Token,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "no-auth",
+			Env:      "",
+			Argument: "no-auth",
+			Default:  false,
+			Usage:    "Send no credentials, for an airflow API authenticated by a proxy in front of it.",
+			Value:    &plugin.NoAuth,
+		},
 		&sensu.SlicePluginConfigOption[string]{
 			Path:      "dag",
 			Env:       "",
@@ -68,267 +410,4297 @@ var (
 			Usage:     "Explicit list of DAGs to check.",
 			Value:     &plugin.Dags,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "dag-run-id",
+			Env:      "",
+			Argument: "dag-run-id",
+			Default:  "",
+			Usage:    "Check this DAG run instead of the latest one, requires a single --dag.",
+			Value:    &plugin.DagRunId,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "tag",
+			Env:                 "",
+			Argument:            "tag",
+			Default:             []string{},
+			Usage:               "Only check the DAGs having this tag when no DAG is given. DAGs having any of the tags are checked when repeated.",
+			Value:               &plugin.Tags,
+			UseCobraStringArray: true,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "exclude-dag",
+			Env:                 "",
+			Argument:            "exclude-dag",
+			Default:             []string{},
+			Usage:               "DAG to leave out when no DAG is given, can be repeated.",
+			Value:               &plugin.ExcludeDags,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "only-active",
+			Env:      "",
+			Argument: "only-active",
+			Default:  false,
+			Usage:    "Only check the DAGs that are not paused when no DAG is given.",
+			Value:    &plugin.OnlyActive,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "warn-on-paused",
+			Env:      "",
+			Argument: "warn-on-paused",
+			Default:  false,
+			Usage:    "Returns warning for paused DAGs also when no DAG is given.",
+			Value:    &plugin.WarnOnPaused,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "warn-on-no-schedule",
+			Env:      "",
+			Argument: "warn-on-no-schedule",
+			Default:  false,
+			Usage:    "Returns warning for unpaused DAGs without a schedule, which only run when triggered.",
+			Value:    &plugin.WarnOnNoSchedule,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "dag-regex",
+			Env:                 "",
+			Argument:            "dag-regex",
+			Default:             []string{},
+			Usage:               "Only check the DAGs matching this RE2 pattern when no DAG is given, can be repeated.",
+			Value:               &plugin.DagRegex,
+			UseCobraStringArray: true,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "exclude-regex",
+			Env:                 "",
+			Argument:            "exclude-regex",
+			Default:             []string{},
+			Usage:               "Leave out the DAGs matching this RE2 pattern when no DAG is given, can be repeated. Wins over --dag-regex.",
+			Value:               &plugin.ExcludeRegex,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "pool",
+			Env:      "",
+			Argument: "pool",
+			Default:  "",
+			Usage:    "Only check DAGs with tasks in this pool. Ignored when DAGs are listed explicitly.",
+			Value:    &plugin.Pool,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "warn-catchup-enabled",
+			Env:      "",
+			Argument: "warn-catchup-enabled",
+			Default:  []string{},
+			Usage:    "List of DAGs that should not have catchup enabled. Returns warning if catchup is enabled for one of them.",
+			Value:    &plugin.WarnCatchup,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "require-tag",
+			Env:      "",
+			Argument: "require-tag",
+			Default:  []string{},
+			Usage:    "Tag every checked DAG must carry. Returns warning for DAGs missing one of the tags.",
+			Value:    &plugin.RequiredTags,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "min-api-success-rate",
+			Env:      "",
+			Argument: "min-api-success-rate",
+			Default:  0,
+			Usage:    "Minimum percentage of successful API calls required to trust the results, transport errors, 5xx and 429 responses counting as failures. Returns unknown if not met.",
+			Value:    &plugin.MinSuccessRate,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "wait-for-completion",
+			Env:      "",
+			Argument: "wait-for-completion",
+			Default:  false,
+			Usage:    "Wait for running or queued DAG runs to finish before evaluating them.",
+			Value:    &plugin.WaitCompletion,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "wait-timeout",
+			Env:      "",
+			Argument: "wait-timeout",
+			Default:  300,
+			Usage:    "Maximum time in seconds to wait for a DAG run to finish, cut short by --timeout which bounds the whole check. Returns unknown if exceeded.",
+			Value:    &plugin.WaitTimeout,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "poll-interval",
+			Env:      "",
+			Argument: "poll-interval",
+			Default:  10,
+			Usage:    "Time in seconds between polls while waiting for a DAG run to finish.",
+			Value:    &plugin.PollInterval,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "warn-no-runs",
+			Env:      "",
+			Argument: "warn-no-runs",
+			Default:  false,
+			Usage:    "Returns warning for unpaused DAGs that have never run.",
+			Value:    &plugin.WarnNoRuns,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "require-runs",
+			Env:      "",
+			Argument: "require-runs",
+			Default:  false,
+			Usage:    "Returns warning for DAGs listed with --dag that have never run.",
+			Value:    &plugin.RequireRuns,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "min-runs",
+			Env:      "",
+			Argument: "min-runs",
+			Default:  0,
+			Usage:    "Minimum number of runs of unpaused DAGs. Returns warning for DAGs that ran fewer times.",
+			Value:    &plugin.MinRuns,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "redact-dag-ids",
+			Env:      "",
+			Argument: "redact-dag-ids",
+			Default:  false,
+			Usage:    "Replace DAG IDs in the output with a stable hash.",
+			Value:    &plugin.RedactDagIds,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "redact-map-file",
+			Env:      "",
+			Argument: "redact-map-file",
+			Default:  "",
+			Usage:    "File to write the mapping of redacted hashes to DAG IDs to, when DAG IDs are redacted.",
+			Value:    &plugin.RedactMapFile,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "any-failed-within",
+			Env:      "",
+			Argument: "any-failed-within",
+			Default:  0,
+			Usage:    "Instead of checking each DAG, return critical if any DAG run failed within this many seconds.",
+			Value:    &plugin.AnyFailedWithin,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "latest-per-run-type",
+			Env:      "",
+			Argument: "latest-per-run-type",
+			Default:  false,
+			Usage:    "Evaluate the latest DAG run of each run type (scheduled, manual, ...) instead of the latest run overall.",
+			Value:    &plugin.LatestPerType,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "skip-active-runs",
+			Env:      "",
+			Argument: "skip-active-runs",
+			Default:  false,
+			Usage:    "Evaluate the latest completed DAG run, paging through the running and queued runs by --history-limit.",
+			Value:    &plugin.SkipActiveRuns,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "history-limit",
+			Env:      "",
+			Argument: "history-limit",
+			Default:  25,
+			Usage:    "Maximum number of DAG runs fetched per request when looking back through run history, including the runs counted by --failure-threshold. A small limit may miss older runs.",
+			Value:    &plugin.HistoryLimit,
+		},
+		&sensu.MapPluginConfigOption[string]{
+			Path:     "run-conf-match",
+			Env:      "",
+			Argument: "run-conf-match",
+			Default:  map[string]string{},
+			Usage:    "Only evaluate the latest DAG run whose conf has these values, as key=value (e.g. tenant=acme). Looks back through --history-limit runs.",
+			Value:    &plugin.RunConfMatch,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:      "verbose",
+			Env:       "",
+			Argument:  "verbose",
+			Shorthand: "v",
+			Default:   false,
+			Usage:     "Also print the DAGs that are OK.",
+			Value:     &plugin.Verbose,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "debug",
+			Env:      "",
+			Argument: "debug",
+			Default:  false,
+			Usage:    "Log the requests made and the decision taken for each DAG to stderr.",
+			Value:    &plugin.Debug,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "timings",
+			Env:      "",
+			Argument: "timings",
+			Default:  false,
+			Usage:    "Print the duration of the check and of the slowest and average DAG to stderr.",
+			Value:    &plugin.Timings,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "summary-only",
+			Env:      "",
+			Argument: "summary-only",
+			Default:  false,
+			Usage:    "Only print the number of DAGs per state instead of a line per DAG.",
+			Value:    &plugin.SummaryOnly,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "quiet-ok",
+			Env:      "",
+			Argument: "quiet-ok",
+			Default:  false,
+			Usage:    "Print nothing when the check is OK. Only applies to the text output.",
+			Value:    &plugin.QuietOk,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "summary-line",
+			Env:      "",
+			Argument: "summary-line",
+			Default:  false,
+			Usage:    "End the text output with a line prefixed with " + summaryLinePrefix + " holding the state and DAG counts as key=value pairs, printed even with --quiet-ok.",
+			Value:    &plugin.SummaryLine,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "fail-fast",
+			Env:      "",
+			Argument: "fail-fast",
+			Default:  false,
+			Usage:    "Stop checking at the first critical DAG.",
+			Value:    &plugin.FailFast,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "list-dags",
+			Env:      "",
+			Argument: "list-dags",
+			Default:  false,
+			Usage:    "Only print the DAGs that would be checked, one per line, without checking them.",
+			Value:    &plugin.ListDags,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "min-dag-count",
+			Env:      "",
+			Argument: "min-dag-count",
+			Default:  0,
+			Usage:    "Minimum number of DAGs to check once the filters are applied. Returns critical if fewer are found.",
+			Value:    &plugin.MinDagCount,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-dags",
+			Env:      "",
+			Argument: "max-dags",
+			Default:  0,
+			Usage:    "Maximum number of discovered DAGs to check, 0 for unlimited. Returns warning when more are found.",
+			Value:    &plugin.MaxDags,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "perfdata",
+			Env:      "",
+			Argument: "perfdata",
+			Default:  false,
+			Usage:    "Append nagios performance data with the DAG counts to the first line of the text output.",
+			Value:    &plugin.Perfdata,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "heartbeat",
+			Env:      "",
+			Argument: "heartbeat",
+			Default:  false,
+			Usage:    "Always print a heartbeat marker line so a watchdog can tell the check is running, even with --quiet-ok.",
+			Value:    &plugin.Heartbeat,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "state-file",
+			Env:      "",
+			Argument: "state-file",
+			Default:  "",
+			Usage:    "File used to keep state between check runs.",
+			Value:    &plugin.StateFile,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "detect-stalled-progress",
+			Env:      "",
+			Argument: "detect-stalled-progress",
+			Default:  false,
+			Usage:    "Returns warning for running DAG runs that completed no task since the previous check. Requires --state-file.",
+			Value:    &plugin.DetectStalled,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "alert-new-failures",
+			Env:      "",
+			Argument: "alert-new-failures",
+			Default:  false,
+			Usage:    "Returns warning instead of critical for a failed DAG run already seen by the previous check. Requires --state-file.",
+			Value:    &plugin.AlertNewFailures,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "check-zombies",
+			Env:      "",
+			Argument: "check-zombies",
+			Default:  false,
+			Usage:    "Returns warning when tasks of a DAG run that already ended are still running.",
+			Value:    &plugin.CheckZombies,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "check-tasks",
+			Env:      "",
+			Argument: "check-tasks",
+			Default:  false,
+			Usage:    "Returns the failed DAG state when tasks of the latest DAG run failed even though the run did not.",
+			Value:    &plugin.CheckTasks,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "check-sla",
+			Env:      "",
+			Argument: "check-sla",
+			Default:  false,
+			Usage:    "Returns warning when tasks of the latest DAG run missed their SLA.",
+			Value:    &plugin.CheckSla,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "check-health",
+			Env:      "",
+			Argument: "check-health",
+			Default:  false,
+			Usage:    "Returns critical if the airflow metadatabase or scheduler is not healthy.",
+			Value:    &plugin.CheckHealth,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "check-import-errors",
+			Env:      "",
+			Argument: "check-import-errors",
+			Default:  false,
+			Usage:    "Returns critical if DAG files failed to import.",
+			Value:    &plugin.CheckImportErrors,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "check-connection",
+			Env:                 "",
+			Argument:            "check-connection",
+			Default:             []string{},
+			Usage:               "Returns critical if this airflow connection does not exist, can be repeated.",
+			Value:               &plugin.CheckConnections,
+			UseCobraStringArray: true,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "check-dataset",
+			Env:                 "",
+			Argument:            "check-dataset",
+			Default:             []string{},
+			Usage:               "Returns warning if the dataset with this URI was not updated within --dataset-max-age, can be repeated.",
+			Value:               &plugin.CheckDatasets,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "dataset-max-age",
+			Env:      "",
+			Argument: "dataset-max-age",
+			Default:  0,
+			Usage:    "Maximum age in seconds of the latest event of the datasets of --check-dataset.",
+			Value:    &plugin.DatasetMaxAge,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "pool-check",
+			Env:                 "",
+			Argument:            "pool-check",
+			Default:             []string{},
+			Usage:               "Returns warning if this airflow pool has no open slots left, can be repeated.",
+			Value:               &plugin.PoolChecks,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "pool-min-slots",
+			Env:      "",
+			Argument: "pool-min-slots",
+			Default:  0,
+			Usage:    "Minimum number of open slots of the pools given with --pool-check. Returns warning if fewer are open.",
+			Value:    &plugin.PoolMinSlots,
+		},
+		&sensu.PluginConfigOption[float64]{
+			Path:     "min-runs-per-minute",
+			Env:      "",
+			Argument: "min-runs-per-minute",
+			Default:  0,
+			Usage:    "Minimum number of DAG runs per minute the scheduler should start across all DAGs. Returns warning if not met.",
+			Value:    &plugin.MinRunsPerMinute,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "run-rate-window",
+			Env:      "",
+			Argument: "run-rate-window",
+			Default:  3600,
+			Usage:    "Time window in seconds over which the DAG run creation rate is computed.",
+			Value:    &plugin.RunRateWindow,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "expect-order",
+			Env:                 "",
+			Argument:            "expect-order",
+			Default:             []string{},
+			Usage:               "Comma separated DAGs that must succeed in this order (e.g. upstream,downstream). Returns warning if a DAG did not succeed after the one before it.",
+			Value:               &plugin.ExpectOrder,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-task-queued-age",
+			Env:      "",
+			Argument: "max-task-queued-age",
+			Default:  0,
+			Usage:    "Maximum time in seconds a task of the latest DAG run may stay queued. Returns warning if exceeded.",
+			Value:    &plugin.MaxTaskQueuedAge,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-retries",
+			Env:      "",
+			Argument: "max-retries",
+			Default:  0,
+			Usage:    "Maximum number of retries of a task of the latest DAG run that did not succeed, 0 to disable. Returns warning if exceeded.",
+			Value:    &plugin.MaxRetries,
+		},
+		&sensu.MapPluginConfigOption[int]{
+			Path:     "expect-task-count",
+			Env:      "",
+			Argument: "expect-task-count",
+			Default:  map[string]int{},
+			Usage:    "Expected number of task instances in the latest run of a DAG, as dag_id=count. Returns warning on deviation.",
+			Value:    &plugin.ExpectTaskCount,
+		},
+		&sensu.MapPluginConfigOption[string]{
+			Path:     "dag-severity",
+			Env:      "",
+			Argument: "dag-severity",
+			Default:  map[string]string{},
+			Usage:    "State returned when a DAG failed, as dag_id=state (e.g. data_quality_audit=warning). Defaults to critical.",
+			Value:    &plugin.DagSeverity,
+		},
+		&sensu.MapPluginConfigOption[string]{
+			Path:     "tag-severity",
+			Env:      "",
+			Argument: "tag-severity",
+			Default:  map[string]string{},
+			Usage:    "State returned when a DAG with this tag failed, as tag=state (e.g. reporting=warning). The most severe state of the tags of a DAG wins.",
+			Value:    &plugin.TagSeverity,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "ok-states",
+			Env:      "",
+			Argument: "ok-states",
+			Default:  []string{"success"},
+			Usage:    "States of a completed DAG run considered healthy, comma separated.",
+			Value:    &plugin.OkStates,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "fail-states",
+			Env:      "",
+			Argument: "fail-states",
+			Default:  []string{"failed"},
+			Usage:    "States of a completed DAG run considered failed, comma separated. Completed runs in neither list are unknown.",
+			Value:    &plugin.FailStates,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:                "dag-ok-states",
+			Env:                 "",
+			Argument:            "dag-ok-states",
+			Default:             []string{},
+			Usage:               "States of a completed run of a DAG considered healthy, as dag_id=state,state (e.g. sensor_dag=success,failed), can be repeated. Overrides --ok-states for the DAG, and these states are never failures for it.",
+			Value:               &plugin.DagOkStates,
+			UseCobraStringArray: true,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "downgrade-failures",
+			Env:      "",
+			Argument: "downgrade-failures",
+			Default:  false,
+			Usage:    "Returns warning instead of critical for failed DAGs, and critical for completed runs in neither --ok-states nor --fail-states.",
+			Value:    &plugin.DowngradeFailures,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "task-count-tolerance",
+			Env:      "",
+			Argument: "task-count-tolerance",
+			Default:  0,
+			Usage:    "Number of task instances the latest DAG run may deviate from the expected task count.",
+			Value:    &plugin.TaskCountTolerance,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-interval-lag",
+			Env:      "",
+			Argument: "max-interval-lag",
+			Default:  0,
+			Usage:    "Maximum time in seconds between the end of a DAG run's data interval and its completion. Returns warning if exceeded.",
+			Value:    &plugin.MaxIntervalLag,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "auth-failure-state",
+			Env:      "",
+			Argument: "auth-failure-state",
+			Default:  "critical",
+			Allow:    checkStateNames,
+			Usage:    "State returned when authentication against the airflow API fails, one of ok, warning, critical or unknown. Defaults to critical.",
+			Value:    &plugin.AuthFailureState,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "trend-file",
+			Env:      "",
+			Argument: "trend-file",
+			Default:  "",
+			Usage:    "File the health percentage of each run is appended to.",
+			Value:    &plugin.TrendFile,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "trend-window",
+			Env:      "",
+			Argument: "trend-window",
+			Default:  0,
+			Usage:    "Reports how the health percentage evolved over this many seconds, requires --trend-file.",
+			Value:    &plugin.TrendWindow,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "textfile-path",
+			Env:      "",
+			Argument: "textfile-path",
+			Default:  "",
+			Usage:    "File the DAG health is written to in the node_exporter textfile collector format.",
+			Value:    &plugin.TextfilePath,
+		},
+		&sensu.MapPluginConfigOption[int]{
+			Path:     "dimension-weight",
+			Env:      "",
+			Argument: "dimension-weight",
+			Default:  map[string]int{},
+			Usage:    "Weights of the check dimensions in the overall status, as dimension=weight (e.g. dags=1,health=4). Enables the weighted rollup.",
+			Value:    &plugin.DimensionWeights,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "failure-threshold",
+			Env:      "",
+			Argument: "failure-threshold",
+			Default:  1,
+			Usage:    "Number of consecutive failed runs required before a DAG is critical.",
+			Value:    &plugin.FailureThreshold,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "critical-percent",
+			Env:      "",
+			Argument: "critical-percent",
+			Default:  0,
+			Usage:    "Returns critical when more than this percentage of DAGs are unhealthy, instead of on any critical DAG.",
+			Value:    &plugin.CriticalPercent,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "warning-percent",
+			Env:      "",
+			Argument: "warning-percent",
+			Default:  0,
+			Usage:    "Returns warning when more than this percentage of DAGs are unhealthy, instead of on any warning DAG.",
+			Value:    &plugin.WarningPercent,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-run-duration",
+			Env:      "",
+			Argument: "max-run-duration",
+			Default:  0,
+			Usage:    "Returns warning if the latest DAG run has been running or queued for longer than this many seconds.",
+			Value:    &plugin.MaxRunDuration,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-age",
+			Env:      "",
+			Argument: "max-age",
+			Default:  0,
+			Usage:    "Returns warning if the latest DAG run is older than this many seconds. DAGs that never ran are ignored.",
+			Value:    &plugin.MaxAge,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "since",
+			Env:      "",
+			Argument: "since",
+			Default:  0,
+			Usage:    "Only evaluate DAG runs with an execution date within this many seconds. Returns warning if there is none.",
+			Value:    &plugin.Since,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "include-logs",
+			Env:      "",
+			Argument: "include-logs",
+			Default:  false,
+			Usage:    "Include the end of the log of a failed task instance when a DAG run failed.",
+			Value:    &plugin.IncludeLogs,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "log-bytes",
+			Env:      "",
+			Argument: "log-bytes",
+			Default:  1024,
+			Usage:    "Maximum number of log bytes included with --include-logs.",
+			Value:    &plugin.LogBytes,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "manifest-file",
+			Env:      "",
+			Argument: "manifest-file",
+			Default:  "",
+			Usage:    "File listing the DAGs that should be loaded, one per line, to compare against the DAGs loaded in airflow.",
+			Value:    &plugin.ManifestFile,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "untracked-state",
+			Env:      "",
+			Argument: "untracked-state",
+			Default:  "warning",
+			Allow:    checkStateNames,
+			Usage:    "State returned for DAGs loaded in airflow but missing from the manifest.",
+			Value:    &plugin.UntrackedState,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "undeployed-state",
+			Env:      "",
+			Argument: "undeployed-state",
+			Default:  "critical",
+			Allow:    checkStateNames,
+			Usage:    "State returned for DAGs in the manifest but not loaded in airflow.",
+			Value:    &plugin.UndeployedState,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "maintenance-aware",
+			Env:      "",
+			Argument: "maintenance-aware",
+			Default:  false,
+			Usage:    "Treat 503 responses as airflow being in maintenance instead of failing the check.",
+			Value:    &plugin.MaintenanceAware,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "maintenance-state",
+			Env:      "",
+			Argument: "maintenance-state",
+			Default:  "ok",
+			Allow:    checkStateNames,
+			Usage:    "State returned when airflow is in maintenance, one of ok, warning, critical or unknown.",
+			Value:    &plugin.MaintenanceState,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "maintenance-window",
+			Env:      "",
+			Argument: "maintenance-window",
+			Default:  "",
+			Usage:    "Daily window in UTC, as HH:MM-HH:MM, outside of which 503 responses are not treated as maintenance.",
+			Value:    &plugin.MaintenanceWindow,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "no-dags-status",
+			Env:      "",
+			Argument: "no-dags-status",
+			Default:  "warning",
+			Allow:    []string{"ok", "warning", "critical"},
+			Usage:    "State returned when no DAG is loaded, one of ok, warning or critical.",
+			Value:    &plugin.NoDagsStatus,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "not-found-state",
+			Env:      "",
+			Argument: "not-found-state",
+			Default:  "warning",
+			Allow:    checkStateNames,
+			Usage:    "State returned for a DAG that does not exist in airflow, one of ok, warning, critical or unknown.",
+			Value:    &plugin.NotFoundState,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "paused-state",
+			Env:      "",
+			Argument: "paused-state",
+			Default:  "warning",
+			Allow:    checkStateNames,
+			Usage:    "State returned for a paused DAG given with --dag or checked with --warn-on-paused, one of ok, warning, critical or unknown.",
+			Value:    &plugin.PausedState,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "all-unknown-state",
+			Env:      "",
+			Argument: "all-unknown-state",
+			Default:  "critical",
+			Allow:    checkStateNames,
+			Usage:    "State returned when the health of none of the DAGs could be determined, one of ok, warning, critical or unknown.",
+			Value:    &plugin.AllUnknownState,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "output",
+			Env:      "",
+			Argument: "output",
+			Default:  outputText,
+			Allow:    []string{outputText, outputCheckResult, outputOpenMetrics, outputJSON},
+			Usage:    "Output format, one of text, check-result (a Sensu event for the agent events API), openmetrics or json.",
+			Value:    &plugin.Output,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "per-dag-timeout",
+			Env:      "",
+			Argument: "per-dag-timeout",
+			Default:  0,
+			Usage:    "Maximum time in seconds spent checking a single DAG. Returns unknown for that DAG if exceeded.",
+			Value:    &plugin.PerDagTimeout,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-total-requests",
+			Env:      "",
+			Argument: "max-total-requests",
+			Default:  0,
+			Usage:    "Maximum number of API requests of a check, 0 for unlimited. The DAGs left unchecked once exhausted are unknown and the check returns warning.",
+			Value:    &plugin.MaxTotalRequests,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "retries",
+			Env:      "",
+			Argument: "retries",
+			Default:  2,
+			Usage:    "Number of times API requests failing with a network error or a 5xx status code are retried.",
+			Value:    &plugin.Retries,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "retry-delay",
+			Env:      "",
+			Argument: "retry-delay",
+			Default:  500,
+			Usage:    "Delay in milliseconds before the first retry, doubled after each retry.",
+			Value:    &plugin.RetryDelay,
+		},
 		&sensu.PluginConfigOption[int]{
 			Path:      "timeout",
 			Env:       "",
 			Argument:  "timeout",
 			Shorthand: "t",
 			Default:   15,
-			Usage:     "Request timeout in seconds",
+			Usage:     "Timeout in seconds of the whole check, also applied to each request",
 			Value:     &plugin.Timeout,
 		},
 	}
-)
+)
+
+func main() {
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
+
+	// the file is applied before the flags are parsed, so that the flags given
+	// on the command line override it
+	if path := configFileArg(os.Args[1:]); path != "" {
+		if err := applyConfigFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config file %s: %v\n", path, err)
+			os.Exit(sensu.CheckStateWarning)
+		}
+	}
+
+	check.Execute()
+}
+
+// configFileArg returns the value of --config-file from the command line
+// arguments, which are only parsed once the check executes.
+func configFileArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		} else if strings.HasPrefix(arg, "--config-file=") {
+			return strings.TrimPrefix(arg, "--config-file=")
+		} else if arg == "--config-file" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// applyConfigFile sets the options found in a YAML or JSON file, keyed by
+// their flag name. Unknown keys are ignored with a warning.
+func applyConfigFile(path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(body, &values); err != nil {
+		return err
+	}
+
+	known := map[string]sensu.ConfigOption{}
+	for _, opt := range options {
+		known[optionArgument(opt)] = opt
+	}
+
+	for key, value := range values {
+		opt, ok := known[key]
+		if !ok {
+			fmt.Fprintf(stderr, "Ignoring unknown option %s in %s\n", key, path)
+			continue
+		}
+
+		raw, ok := value.(string)
+		if !ok {
+			encoded, err := json.Marshal(jsonValue(value))
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %v", key, err)
+			}
+			raw = string(encoded)
+		}
+		if err := opt.SetValue(raw); err != nil {
+			return fmt.Errorf("invalid value of %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// jsonValue converts the maps decoded from YAML, keyed by interface{}, to
+// maps that can be encoded to JSON.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+	}
+	return value
+}
+
+// optionArgument returns the flag name of an option.
+func optionArgument(opt sensu.ConfigOption) string {
+	switch o := opt.(type) {
+	case *sensu.PluginConfigOption[string]:
+		return o.Argument
+	case *sensu.PluginConfigOption[int]:
+		return o.Argument
+	case *sensu.PluginConfigOption[bool]:
+		return o.Argument
+	case *sensu.PluginConfigOption[float64]:
+		return o.Argument
+	case *sensu.SlicePluginConfigOption[string]:
+		return o.Argument
+	case *sensu.SlicePluginConfigOption[int]:
+		return o.Argument
+	case *sensu.MapPluginConfigOption[string]:
+		return o.Argument
+	case *sensu.MapPluginConfigOption[int]:
+		return o.Argument
+	}
+	return ""
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	var err error
+	for _, instance := range append([]string{plugin.AirflowApiUrl}, plugin.AirflowApiUrls...) {
+		if err = validateUrl(instance); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+
+	if plugin.GraphqlUrl != "" {
+		if err = validateUrl(plugin.GraphqlUrl); err != nil {
+			return sensu.CheckStateWarning, err
+		} else if len(plugin.AirflowApiUrls) > 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("--graphql-url cannot be combined with --urls")
+		}
+	}
+
+	if len(plugin.AirflowApiUrls) > 0 {
+		if plugin.Output != outputText {
+			return sensu.CheckStateWarning, fmt.Errorf("--urls only supports the %s output", outputText)
+		}
+		if len(plugin.AirflowUsernames) > 0 && len(plugin.AirflowUsernames) != len(plugin.AirflowApiUrls) {
+			return sensu.CheckStateWarning, fmt.Errorf("--usernames must list one username per URL of --urls")
+		}
+		if len(plugin.AirflowPasswords) > 0 && len(plugin.AirflowPasswords) != len(plugin.AirflowApiUrls) {
+			return sensu.CheckStateWarning, fmt.Errorf("--passwords must list one password per URL of --urls")
+		}
+	}
+
+	var empty int
+	if plugin.Dags, empty = normalizeDagIds(plugin.Dags); empty > 0 {
+		fmt.Fprintf(stderr, "Ignoring %d empty DAG IDs in --dag\n", empty)
+	}
+
+	if plugin.DagRunId != "" && len(plugin.Dags) != 1 {
+		return sensu.CheckStateWarning, fmt.Errorf("--dag-run-id requires a single --dag")
+	}
+
+	if strings.Trim(plugin.ApiVersion, "/") == "" {
+		return sensu.CheckStateWarning, fmt.Errorf("--api-version must not be empty")
+	}
+
+	if strings.TrimSpace(plugin.AcceptHeader) == "" {
+		return sensu.CheckStateWarning, fmt.Errorf("--accept-header must not be empty")
+	}
+
+	for _, code := range plugin.OkStatusCodes {
+		if code < 100 || code > 599 {
+			return sensu.CheckStateWarning, fmt.Errorf("--ok-status-codes must be HTTP status codes, got %d", code)
+		}
+	}
+
+	if plugin.PasswordFile != "" {
+		if plugin.AirflowPassword != "" {
+			return sensu.CheckStateWarning, fmt.Errorf("--password and --password-file are mutually exclusive")
+		}
+		if plugin.AirflowPassword, err = readPasswordFile(plugin.PasswordFile); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+
+	if !plugin.NoAuth && plugin.Token == "" && plugin.AirflowUsername == "" && len(plugin.AirflowUsernames) == 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("airflow username is required")
+	}
+
+	if !plugin.NoAuth && plugin.Token == "" && plugin.AirflowPassword == "" && len(plugin.AirflowPasswords) == 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("airflow password is required")
+	}
+
+	if plugin.dagPatterns, err = compilePatterns(plugin.DagRegex); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+
+	if plugin.excludePatterns, err = compilePatterns(plugin.ExcludeRegex); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+
+	if plugin.customHeaders, err = parseHeaders(plugin.Headers); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+
+	if plugin.okStatesByDag, err = parseDagStates(plugin.DagOkStates); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+
+	if plugin.Proxy != "" {
+		proxyURL, err := url.Parse(plugin.Proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid proxy URL %s", plugin.Proxy)
+		}
+	}
+
+	if plugin.CACert != "" {
+		if plugin.rootCAs, err = loadCACert(plugin.CACert); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+
+	if (plugin.ClientCert == "") != (plugin.ClientKey == "") {
+		return sensu.CheckStateWarning, fmt.Errorf("--client-cert and --client-key must be provided together")
+	} else if plugin.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(plugin.ClientCert, plugin.ClientKey)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("failed to load client certificate %s: %v", plugin.ClientCert, err)
+		}
+		plugin.clientCerts = []tls.Certificate{cert}
+	}
+
+	if plugin.MinSuccessRate < 0 || plugin.MinSuccessRate > 100 {
+		return sensu.CheckStateWarning, fmt.Errorf("min API success rate must be between 0 and 100")
+	}
+
+	if plugin.CriticalPercent < 0 || plugin.CriticalPercent > 100 || plugin.WarningPercent < 0 || plugin.WarningPercent > 100 {
+		return sensu.CheckStateWarning, fmt.Errorf("--critical-percent and --warning-percent must be between 0 and 100")
+	} else if plugin.CriticalPercent > 0 && plugin.WarningPercent > plugin.CriticalPercent {
+		return sensu.CheckStateWarning, fmt.Errorf("--warning-percent must not exceed --critical-percent")
+	}
+
+	if plugin.TrendWindow > 0 && plugin.TrendFile == "" {
+		return sensu.CheckStateWarning, fmt.Errorf("--trend-window requires --trend-file")
+	}
+
+	if plugin.DetectStalled && plugin.StateFile == "" {
+		return sensu.CheckStateWarning, fmt.Errorf("a state file is required to detect stalled progress")
+	}
+
+	if plugin.AlertNewFailures && plugin.StateFile == "" {
+		return sensu.CheckStateWarning, fmt.Errorf("a state file is required to alert on new failures")
+	}
+
+	if plugin.MinRunsPerMinute > 0 && plugin.RunRateWindow <= 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("run rate window must be greater than 0")
+	}
+
+	for _, order := range plugin.ExpectOrder {
+		if len(parseDagOrder(order)) < 2 {
+			return sensu.CheckStateWarning, fmt.Errorf("expected order must list at least two DAGs: %s", order)
+		}
+	}
+
+	if plugin.MaintenanceWindow != "" {
+		if _, _, err := parseMaintenanceWindow(plugin.MaintenanceWindow); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+
+	for dagId, state := range plugin.DagSeverity {
+		if _, ok := checkStates[state]; !ok {
+			return sensu.CheckStateWarning, fmt.Errorf("--dag-severity for %s must be one of %s", dagId, strings.Join(checkStateNames, ", "))
+		}
+	}
+
+	for tag, state := range plugin.TagSeverity {
+		if _, ok := checkStates[state]; !ok {
+			return sensu.CheckStateWarning, fmt.Errorf("--tag-severity for %s must be one of %s", tag, strings.Join(checkStateNames, ", "))
+		}
+	}
+
+	for dimension, weight := range plugin.DimensionWeights {
+		if weight < 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("--dimension-weight for %s must not be negative", dimension)
+		}
+	}
+
+	if plugin.IncludeLogs && plugin.LogBytes <= 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--log-bytes must be greater than 0")
+	}
+
+	if plugin.Retries < 0 || plugin.RetryDelay < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--retries and --retry-delay must not be negative")
+	}
+
+	if plugin.FailureThreshold <= 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--failure-threshold must be greater than 0")
+	}
+
+	if plugin.PoolMinSlots < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--pool-min-slots must not be negative")
+	}
+
+	if plugin.MinDagCount < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--min-dag-count must not be negative")
+	}
+
+	if len(plugin.CheckDatasets) > 0 && plugin.DatasetMaxAge <= 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--check-dataset requires a --dataset-max-age greater than 0")
+	}
+
+	if plugin.MaxRetries < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--max-retries must not be negative")
+	}
+
+	if plugin.MaxTotalRequests < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--max-total-requests must not be negative")
+	}
+
+	if plugin.MaxIdleConns < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--max-idle-conns must not be negative")
+	}
+
+	if plugin.MaxDags < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--max-dags must not be negative")
+	}
+
+	if plugin.Since < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--since must not be negative")
+	}
+
+	if plugin.MinRuns < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--min-runs must not be negative")
+	}
+
+	if plugin.HistoryLimit <= 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("history limit must be greater than 0")
+	}
+
+	if plugin.WaitCompletion && (plugin.WaitTimeout <= 0 || plugin.PollInterval <= 0) {
+		return sensu.CheckStateWarning, fmt.Errorf("wait timeout and poll interval must be greater than 0")
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+// validateUrl verifies an airflow URL can be requested.
+func validateUrl(raw string) error {
+	apiUrl, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse airflow URL %s: %v", raw, err)
+	} else if apiUrl.Scheme != "http" && apiUrl.Scheme != "https" {
+		return fmt.Errorf("airflow URL %s must start with http:// or https://", raw)
+	} else if apiUrl.Host == "" {
+		return fmt.Errorf("airflow URL %s must include a host", raw)
+	}
+	return nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+	if len(plugin.AirflowApiUrls) > 0 {
+		return printInstances(os.Stdout)
+	}
+
+	if plugin.Output == outputCheckResult {
+		return printCheckResult()
+	} else if plugin.Output == outputOpenMetrics {
+		return printOpenMetrics()
+	} else if plugin.Output == outputJSON {
+		return printJSON(os.Stdout)
+	}
+
+	return printText(os.Stdout)
+}
+
+type VersionInfo struct {
+	Version string `json:"version"`
+}
+
+var airflowVersion = regexp.MustCompile(`^\d+\.\d+`)
+
+// verifyEndpoint checks that the API reports an airflow version, as responses
+// of another API would otherwise decode into empty results. Unreachable APIs
+// and rejected credentials are left to the check to report.
+func verifyEndpoint(ctx context.Context, w io.Writer, api *apiClient) bool {
+	var version VersionInfo
+	err := api.get(ctx, "/version", nil, &version)
+	if err == nil && !airflowVersion.MatchString(version.Version) {
+		err = fmt.Errorf("unexpected version %q", version.Version)
+	}
+	if err == nil || isUnreachable(err) || isAuthFailure(err) {
+		return true
+	}
+
+	fmt.Fprintf(w, "Endpoint does not look like an Airflow REST API: %s\n%v\n", api.baseUrl, err)
+	return false
+}
+
+// printText writes the human readable output of the check, followed by the
+// summary line when enabled.
+func printText(w io.Writer) (int, error) {
+	status, summary, err := printCheckOutput(w, plugin, newRequestBudget(plugin.MaxTotalRequests))
+	if plugin.SummaryLine {
+		fmt.Fprintln(w, formatSummaryLine(status, summary))
+	}
+	return status, err
+}
+
+// printCheckOutput writes the human readable output of the check, which is
+// dropped with --quiet-ok when the check is OK, followed by the heartbeat
+// when enabled.
+func printCheckOutput(w io.Writer, cfg Config, budget *requestBudget) (int, *Summary, error) {
+	var output bytes.Buffer
+	status, summary, err := writeText(&output, cfg, budget)
+	if !plugin.QuietOk || status != sensu.CheckStateOK || err != nil {
+		_, _ = output.WriteTo(w)
+	}
+	if plugin.Heartbeat {
+		printHeartbeat(w)
+	}
+	return status, summary, err
+}
+
+const summaryLinePrefix = "AIRFLOW-CHECK-SUMMARY"
+
+// formatSummaryLine returns the line of --summary-line, with stable keys for
+// log scraping. The counts are 0 when no DAG was checked.
+func formatSummaryLine(status int, summary *Summary) string {
+	if summary == nil {
+		summary = &Summary{}
+	}
+	return fmt.Sprintf("%s state=%s dags=%d ok=%d warn=%d crit=%d unknown=%d paused=%d",
+		summaryLinePrefix, strings.ToLower(stateName(status)), len(summary.Dags),
+		summary.Oks, summary.Warnings, summary.Criticals, summary.Unknowns, summary.Paused)
+}
+
+// writeText writes the human readable output of the check, followed by the
+// performance data when enabled.
+func writeText(w io.Writer, cfg Config, budget *requestBudget) (int, *Summary, error) {
+	if !plugin.Perfdata {
+		return checkDagHealthWithin(w, cfg, budget)
+	}
+
+	var output bytes.Buffer
+	status, summary, err := checkDagHealthWithin(&output, cfg, budget)
+
+	text := strings.TrimRight(output.String(), "\n")
+	if summary != nil {
+		// the performance data follows the first line of output, per the
+		// nagios plugin output format
+		first, rest, _ := strings.Cut(text, "\n")
+		text = first + " | " + formatPerfdata(summary)
+		if rest != "" {
+			text += "\n" + rest
+		}
+	}
+	fmt.Fprintln(w, text)
+
+	return status, summary, err
+}
+
+// printInstances checks each airflow instance given with --urls in turn,
+// prefixing its output lines with the host of the instance, and returns the
+// worst state of all instances. The summary line and the request budget
+// cover all instances.
+func printInstances(w io.Writer) (int, error) {
+	status := sensu.CheckStateOK
+	total := &Summary{}
+	budget := newRequestBudget(plugin.MaxTotalRequests)
+	for i, instance := range plugin.AirflowApiUrls {
+		cfg := plugin
+		cfg.AirflowApiUrl = instance
+		if len(plugin.AirflowUsernames) > 0 {
+			cfg.AirflowUsername = plugin.AirflowUsernames[i]
+		}
+		if len(plugin.AirflowPasswords) > 0 {
+			cfg.AirflowPassword = plugin.AirflowPasswords[i]
+		}
+
+		var output bytes.Buffer
+		instanceStatus, summary, err := printCheckOutput(&output, cfg, budget)
+		if err != nil {
+			fmt.Fprintln(&output, err)
+		}
+		status = worstState(status, instanceStatus)
+		total.add(summary)
+
+		host := instance
+		if u, err := url.Parse(instance); err == nil {
+			host = u.Host
+		}
+		if output.Len() == 0 {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(output.String(), "\n"), "\n") {
+			fmt.Fprintf(w, "%s: %s\n", host, line)
+		}
+	}
+
+	if plugin.SummaryLine {
+		fmt.Fprintln(w, formatSummaryLine(status, total))
+	}
+	return status, nil
+}
+
+func formatPerfdata(summary *Summary) string {
+	return fmt.Sprintf("oks=%d warnings=%d criticals=%d unknowns=%d paused=%d dags_checked=%d",
+		summary.Oks, summary.Warnings, summary.Criticals, summary.Unknowns, summary.Paused, len(summary.Dags))
+}
+
+// printTimings prints the duration of the check since start, and of the
+// slowest and average DAG checked.
+func printTimings(start time.Time, health []Health) {
+	fmt.Fprintf(stderr, "timings: total %s\n", time.Since(start).Round(time.Millisecond))
+	if len(health) == 0 {
+		return
+	}
+
+	var total time.Duration
+	slowest := health[0]
+	for _, h := range health {
+		total += h.Duration
+		if h.Duration > slowest.Duration {
+			slowest = h
+		}
+	}
+	fmt.Fprintf(stderr, "timings: slowest DAG %s %s\n", slowest.DagId, slowest.Duration.Round(time.Millisecond))
+	fmt.Fprintf(stderr, "timings: average %s over %d DAGs\n", (total / time.Duration(len(health))).Round(time.Millisecond), len(health))
+}
+
+// printHeartbeat prints a marker line showing the check itself ran, whatever
+// the state of the DAGs.
+func printHeartbeat(w io.Writer) {
+	fmt.Fprintln(w, formatHeartbeat())
+}
+
+func formatHeartbeat() string {
+	return fmt.Sprintf("%s heartbeat ok at %s", plugin.Name, time.Now().UTC().Format(time.RFC3339))
+}
+
+// Summary holds the health of the checked DAGs and their number per check state.
+type Summary struct {
+	Dags      []Health
+	Findings  []Finding
+	Oks       int
+	Warnings  int
+	Criticals int
+	Unknowns  int
+	// paused DAGs are counted apart from the states above
+	Paused int
+}
+
+// add adds the DAGs and counts of another summary, nil for an instance that
+// was not checked.
+func (s *Summary) add(other *Summary) {
+	if other == nil {
+		return
+	}
+	s.Dags = append(s.Dags, other.Dags...)
+	s.Findings = append(s.Findings, other.Findings...)
+	s.Oks += other.Oks
+	s.Warnings += other.Warnings
+	s.Criticals += other.Criticals
+	s.Unknowns += other.Unknowns
+	s.Paused += other.Paused
+}
+
+// checked returns the number of DAGs whose health was evaluated, leaving out
+// the paused DAGs.
+func (s *Summary) checked() int {
+	return len(s.Dags) - s.Paused
+}
+
+func checkDagHealth(w io.Writer) (int, *Summary, error) {
+	return checkDagHealthWithin(w, plugin, newRequestBudget(plugin.MaxTotalRequests))
+}
+
+// checkDagHealthWithin runs the check against the airflow instance of cfg,
+// charging its API requests to the budget.
+func checkDagHealthWithin(w io.Writer, cfg Config, budget *requestBudget) (int, *Summary, error) {
+	start := time.Now()
+	client, err := newAirflowClient(cfg, budget)
+	if err != nil {
+		return sensu.CheckStateUnknown, nil, err
+	}
+	transport := client.Transport.(*countingTransport)
+
+	// DAGs are memoized for the duration of the check
+	api := newAPIClient(cfg, client)
+	api.dags = map[string]*Dag{}
+	api.budget = budget
+
+	// the timeout bounds the whole check, not only each request
+	ctx := context.Background()
+	if plugin.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plugin.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	if plugin.VerifyEndpoint && !verifyEndpoint(ctx, w, api) {
+		return sensu.CheckStateCritical, nil, nil
+	}
+
+	// a single request tells wrong credentials apart before checking anything
+	if err := probeAuth(ctx, api); err == errAuthFailed {
+		return authFailed(w)
+	} else if isUnreachable(err) {
+		// every DAG would fail the same way, report the root cause once
+		fmt.Fprintf(w, "Airflow API unreachable at %s: %v\n", cfg.AirflowApiUrl, err)
+		return sensu.CheckStateCritical, nil, nil
+	}
+
+	if plugin.AnyFailedWithin > 0 {
+		return checkFailedInWindow(ctx, w, api)
+	}
+
+	explicit := true
+	dags := plugin.Dags
+
+	// all the DAGs loaded, when discovery listed them unfiltered
+	var loaded *DagList
+
+	if len(dags) == 0 {
+		explicit = false
+		filter := discoveryFilter()
+		var dagList *DagList
+		dagList, err = api.getAllDags(ctx, filter)
+		if isAuthFailure(err) {
+			return authFailed(w)
+		} else if isMaintenance(err) {
+			return maintenance(w)
+		} else if errors.Is(err, errRequestBudget) {
+			return budgetExceeded(w, "before the DAGs were discovered")
+		} else if err != nil {
+			return sensu.CheckStateCritical, nil, fmt.Errorf("could not retrieve DAGs: %v", err)
+		} else {
+			dags = selectDags(dagList.Dags)
+		}
+		if len(filter) == 0 {
+			loaded = dagList
+		}
+
+		if plugin.Pool != "" {
+			var pool *Pool
+			pool, err = getPool(ctx, plugin.Pool, api)
+			if errors.Is(err, errRequestBudget) {
+				return budgetExceeded(w, "before the pool was retrieved")
+			} else if err != nil {
+				return sensu.CheckStateCritical, nil, fmt.Errorf("could not retrieve pool %s: %v", plugin.Pool, err)
+			} else if pool == nil {
+				fmt.Fprintf(w, "Pool does not exist: %s\n", plugin.Pool)
+				return sensu.CheckStateWarning, nil, nil
+			}
+
+			dags, err = filterDagsByPool(ctx, dags, plugin.Pool, api)
+			if errors.Is(err, errRequestBudget) {
+				return budgetExceeded(w, "before the DAG tasks were retrieved")
+			} else if err != nil {
+				return sensu.CheckStateCritical, nil, fmt.Errorf("could not retrieve DAG tasks: %v", err)
+			}
+		}
+	}
+
+	// a DAG selected more than once is only checked once
+	dags = dedupe(dags)
+
+	if plugin.ListDags {
+		for _, dagId := range dags {
+			fmt.Fprintln(w, dagId)
+		}
+		return sensu.CheckStateOK, nil, nil
+	}
+
+	findings := checkInstance(ctx, api, loaded)
+	if plugin.MinDagCount > 0 {
+		findings = append(findings, checkDagCount(len(dags)))
+	}
+	if !explicit && plugin.MaxDags > 0 && len(dags) > plugin.MaxDags {
+		findings = append(findings, Finding{
+			Dimension: "inventory",
+			Status:    sensu.CheckStateWarning,
+			Message:   fmt.Sprintf("Checking only the first %d of %d discovered DAGs, narrow the filters to check them all", plugin.MaxDags, len(dags)),
+		})
+		dags = dags[:plugin.MaxDags]
+	}
+
+	if plugin.StateFile != "" {
+		loadState()
+	}
+
+	if plugin.GraphqlUrl != "" {
+		if err := api.queryDags(ctx, plugin.GraphqlUrl, plugin.GraphqlCredentials, dags); err != nil {
+			debugf("GraphQL query failed, falling back to the REST API: %v", err)
+		}
+	}
+
+	health, err := checkDags(ctx, dags, explicit, api)
+	if plugin.Timings {
+		defer printTimings(start, health)
+	}
+	if err == errAuthFailed {
+		return authFailed(w)
+	} else if err == errMaintenance {
+		return maintenance(w)
+	}
+
+	if plugin.StateFile != "" {
+		if err := saveState(); err != nil {
+			fmt.Fprintf(w, "Failed to write state file:\n%v\n", err)
+		}
+	}
+
+	if plugin.RedactDagIds {
+		if err := redactHealth(health); err != nil {
+			fmt.Fprintf(w, "Failed to write DAG ID mapping file:\n%v\n", err)
+		}
+	}
+
+	if rate := transport.successRate(); rate < plugin.MinSuccessRate {
+		fmt.Fprintf(w, "Results unreliable: only %d%% of API calls succeeded\n", rate)
+		return sensu.CheckStateUnknown, nil, nil
+	}
+
+	summary := Summary{Dags: health, Findings: findings}
+	found := false
+
+	for _, f := range findings {
+		if f.Status != sensu.CheckStateOK {
+			fmt.Fprintf(w, "%s %s\n%s\n", f.Dimension, stateName(f.Status), f.Message)
+		}
+	}
+
+	// with --summary-only the DAG lines are dropped, only their count is printed
+	dagOutput := w
+	if plugin.SummaryOnly {
+		dagOutput = io.Discard
+	}
+
+	for _, h := range health {
+		found = true
+		switch {
+		case h.Paused:
+			summary.Paused++
+			fmt.Fprintf(dagOutput, "%s PAUSED\n", h.DagId)
+		case h.Status == sensu.CheckStateOK:
+			summary.Oks++
+			if plugin.Verbose {
+				fmt.Fprintf(dagOutput, "%s OK\n", h.DagId)
+			}
+		case h.Status == sensu.CheckStateWarning:
+			summary.Warnings++
+			fmt.Fprintf(dagOutput, "%s WARNING\n", h.DagId)
+		case h.Status == sensu.CheckStateCritical:
+			summary.Criticals++
+			fmt.Fprintf(dagOutput, "%s CRITICAL\n", h.DagId)
+		default:
+			summary.Unknowns++
+			fmt.Fprintf(dagOutput, "%s Unknown error code returned\n", h.DagId)
+		}
+
+		if h.Error != nil {
+			fmt.Fprintf(dagOutput, "Error occurred while checking DAG:\n%v\n", h.Error)
+		}
+	}
+
+	if plugin.SummaryOnly && found {
+		fmt.Fprintf(w, "%d of %d DAGs unhealthy: %d OK, %d WARNING, %d CRITICAL, %d UNKNOWN, %d PAUSED\n",
+			summary.checked()-summary.Oks, summary.checked(), summary.Oks, summary.Warnings, summary.Criticals, summary.Unknowns, summary.Paused)
+	}
+
+	unchecked := 0
+	for _, h := range health {
+		if errors.Is(h.Error, errRequestBudget) {
+			unchecked++
+		}
+	}
+
+	var status int
+	if unchecked > 0 {
+		// the DAGs left unchecked tell nothing about their health, the
+		// budget itself is what needs attention
+		fmt.Fprintf(w, "Request budget of %d exceeded, %d of %d DAGs not checked\n", plugin.MaxTotalRequests, unchecked, len(health))
+		status = sensu.CheckStateWarning
+		if summary.Criticals > 0 || summary.Unknowns > unchecked {
+			status = sensu.CheckStateCritical
+		}
+	} else if found && summary.checked() > 0 && summary.Unknowns == summary.checked() {
+		fmt.Fprintf(w, "Unable to determine health for any DAG\n")
+		status = checkStates[plugin.AllUnknownState]
+	} else if found && summary.checked() > 0 && (plugin.CriticalPercent > 0 || plugin.WarningPercent > 0) {
+		// the share of unhealthy DAGs overrides the state of each DAG, paused
+		// DAGs are neither healthy nor unhealthy
+		unhealthy := summary.checked() - summary.Oks
+		fmt.Fprintf(w, "%.1f%% of DAGs unhealthy\n", float64(unhealthy*100)/float64(summary.checked()))
+		status = percentState(unhealthy, summary.checked())
+		if summary.Paused > 0 {
+			status = worstState(status, checkStates[plugin.PausedState])
+		}
+	} else if summary.Criticals > 0 || summary.Unknowns > 0 {
+		status = sensu.CheckStateCritical
+	} else if summary.Warnings > 0 || summary.Paused > 0 {
+		if summary.Warnings > 0 {
+			status = sensu.CheckStateWarning
+		}
+		if summary.Paused > 0 {
+			status = worstState(status, checkStates[plugin.PausedState])
+		}
+	} else if found {
+		fmt.Fprintf(w, "All health checks returning OK for loaded DAGs\n")
+	} else if instanceOnly(findings) {
+		// the findings alone set the state, the unhealthy ones printed above
+		healthy := true
+		for _, f := range findings {
+			healthy = healthy && f.Status == sensu.CheckStateOK
+		}
+		if healthy {
+			fmt.Fprintf(w, "All instance health checks returning OK\n")
+		}
+	} else if !explicit && (len(plugin.dagPatterns) > 0 || len(plugin.excludePatterns) > 0) {
+		fmt.Fprintf(w, "No DAGs matched\n")
+		status = checkStates[plugin.NoDagsStatus]
+	} else {
+		fmt.Fprintf(w, "No DAGs loaded\n")
+		status = checkStates[plugin.NoDagsStatus]
+	}
+
+	if plugin.TrendFile != "" && summary.checked() > 0 {
+		percent := summary.Oks * 100 / summary.checked()
+		trend, err := recordTrend(time.Now(), percent)
+		if err != nil {
+			fmt.Fprintf(w, "Failed to write trend file:\n%v\n", err)
+		} else if trend != "" {
+			fmt.Fprintf(w, "%s\n", trend)
+		}
+	}
+
+	if plugin.TextfilePath != "" {
+		if err := writeTextfile(plugin.TextfilePath, &summary); err != nil {
+			fmt.Fprintf(w, "Failed to write textfile:\n%v\n", err)
+		}
+	}
+
+	if len(plugin.DimensionWeights) > 0 {
+		var score float64
+		status, score = weightedRollup(status, findings)
+		fmt.Fprintf(w, "Weighted health score: %.2f\n", score)
+	} else {
+		for _, f := range findings {
+			status = worstState(status, f.Status)
+		}
+	}
+
+	return status, &summary, nil
+}
+
+// instanceOnly reports whether only instance wide checks were requested, with
+// no option selecting the DAGs to check.
+func instanceOnly(findings []Finding) bool {
+	return len(findings) > 0 && len(plugin.Dags) == 0 && len(plugin.DagRegex) == 0 &&
+		len(plugin.ExcludeRegex) == 0 && len(plugin.Tags) == 0 && plugin.Pool == ""
+}
+
+// percentState returns the state of --critical-percent and --warning-percent
+// for the number of unhealthy DAGs out of total.
+func percentState(unhealthy int, total int) int {
+	if plugin.CriticalPercent > 0 && unhealthy*100 > plugin.CriticalPercent*total {
+		return sensu.CheckStateCritical
+	} else if plugin.WarningPercent > 0 && unhealthy*100 > plugin.WarningPercent*total {
+		return sensu.CheckStateWarning
+	}
+	return sensu.CheckStateOK
+}
+
+// weightedRollup derives the overall status from the weighted mean of the
+// severity of each dimension, the DAG results forming the "dags" dimension.
+// Severities are 0 for ok, 1 for warning and 2 for critical or unknown, and
+// dimensions without a configured weight weigh 1. The mean is rounded to the
+// nearest state.
+func weightedRollup(dagStatus int, findings []Finding) (int, float64) {
+	severities := map[string]int{"dags": dagStatus}
+	for _, f := range findings {
+		severities[f.Dimension] = worstState(severities[f.Dimension], f.Status)
+	}
+
+	var total, weights float64
+	for dimension, severity := range severities {
+		weight := 1
+		if w, ok := plugin.DimensionWeights[dimension]; ok {
+			weight = w
+		}
+		if severity == sensu.CheckStateUnknown {
+			severity = sensu.CheckStateCritical
+		}
+		total += float64(weight * severity)
+		weights += float64(weight)
+	}
+
+	if weights <= 0 {
+		return sensu.CheckStateOK, 0
+	}
+
+	score := total / weights
+	return int(score + 0.5), score
+}
+
+func authFailed(w io.Writer) (int, *Summary, error) {
+	fmt.Fprintf(w, "Authentication to Airflow failed, check credentials\n")
+	return checkStates[plugin.AuthFailureState], nil, nil
+}
+
+// probeAuth lists a single DAG to verify the credentials, returning
+// errAuthFailed when they are rejected. Other errors are left to the checks.
+func probeAuth(ctx context.Context, api *apiClient) error {
+	var result DagList
+	err := api.get(ctx, "/dags", url.Values{"limit": {"1"}}, &result)
+	if isAuthFailure(err) || isStatus(err, http.StatusForbidden) {
+		return errAuthFailed
+	}
+	return err
+}
+
+func maintenance(w io.Writer) (int, *Summary, error) {
+	fmt.Fprintf(w, "Airflow in maintenance\n")
+	return checkStates[plugin.MaintenanceState], nil, nil
+}
+
+// budgetExceeded reports a check cut short by the request budget, which says
+// nothing of the health of the DAGs.
+func budgetExceeded(w io.Writer, step string) (int, *Summary, error) {
+	fmt.Fprintf(w, "Request budget of %d exceeded %s\n", plugin.MaxTotalRequests, step)
+	return sensu.CheckStateWarning, nil, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DAG regex %s: %v", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, dagId string) bool {
+	for _, re := range patterns {
+		if re.MatchString(dagId) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDagIds splits comma joined DAG IDs, trims them and drops
+// duplicates, returning the number of empty IDs dropped.
+func normalizeDagIds(values []string) ([]string, int) {
+	var dagIds []string
+	empty := 0
+	for _, v := range values {
+		for _, dagId := range strings.Split(v, ",") {
+			if dagId = strings.TrimSpace(dagId); dagId == "" {
+				empty++
+			} else {
+				dagIds = append(dagIds, dagId)
+			}
+		}
+	}
+	return dedupe(dagIds), empty
+}
+
+// dedupe returns the values without duplicates, in their original order.
+func dedupe(values []string) []string {
+	result := make([]string, 0, len(values))
+	seen := map[string]bool{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// discoveryFilter returns the query parameters restricting the DAGs listed
+// when no DAG is given.
+func discoveryFilter() url.Values {
+	filter := url.Values{}
+	for _, tag := range plugin.Tags {
+		filter.Add("tags", tag)
+	}
+	if plugin.OnlyActive {
+		filter.Set("paused", "false")
+	}
+	return filter
+}
+
+// selectDags returns the IDs of the discovered DAGs matching the DAG patterns,
+// if any, leaving out the excluded ones.
+func selectDags(discovered []Dag) []string {
+	dags := make([]string, 0, len(discovered))
+	for _, d := range discovered {
+		if contains(plugin.ExcludeDags, d.DagId) || matchesAny(plugin.excludePatterns, d.DagId) {
+			continue
+		} else if plugin.OnlyActive && d.IsPaused {
+			continue
+		} else if len(plugin.dagPatterns) > 0 && !matchesAny(plugin.dagPatterns, d.DagId) {
+			continue
+		}
+		dags = append(dags, d.DagId)
+	}
+	return dags
+}
+
+// Finding is the outcome of a check covering the whole airflow instance
+// rather than a single DAG.
+type Finding struct {
+	Dimension string
+	Status    int
+	Message   string
+}
+
+// checkInstance runs the configured instance wide checks, given the DAGs
+// loaded in airflow when already listed.
+func checkInstance(ctx context.Context, api *apiClient, loaded *DagList) []Finding {
+	var findings []Finding
+
+	if plugin.CheckHealth {
+		findings = append(findings, checkInstanceHealth(ctx, api))
+	}
+
+	if plugin.CheckImportErrors {
+		findings = append(findings, checkImportErrors(ctx, api))
+	}
+
+	for _, connId := range plugin.CheckConnections {
+		findings = append(findings, checkConnection(ctx, connId, api))
+	}
+
+	for _, uri := range plugin.CheckDatasets {
+		findings = append(findings, checkDataset(ctx, uri, api))
+	}
+
+	for _, name := range plugin.PoolChecks {
+		findings = append(findings, checkPoolSlots(ctx, name, api))
+	}
+
+	if plugin.MinRunsPerMinute > 0 {
+		findings = append(findings, checkRunRate(ctx, api))
+	}
+
+	for _, order := range plugin.ExpectOrder {
+		findings = append(findings, checkRunOrder(ctx, parseDagOrder(order), api))
+	}
+
+	if plugin.ManifestFile != "" {
+		findings = append(findings, checkManifest(ctx, api, loaded)...)
+	}
+
+	return findings
+}
+
+// readManifest reads the DAG IDs listed in the manifest file, one per line.
+// Blank lines and lines starting with # are ignored.
+func readManifest(path string) ([]string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var dags []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dags = append(dags, line)
+	}
+	return dags, nil
+}
+
+// checkManifest compares the DAGs loaded in airflow against the manifest,
+// reporting DAGs missing from the manifest (untracked) and DAGs missing from
+// airflow (undeployed). The DAGs are listed unless given.
+func checkManifest(ctx context.Context, api *apiClient, dagList *DagList) []Finding {
+	manifest, err := readManifest(plugin.ManifestFile)
+	if err != nil {
+		return []Finding{{Dimension: "inventory", Status: sensu.CheckStateUnknown, Message: fmt.Sprintf("could not read manifest file: %v", err)}}
+	}
+
+	if dagList == nil {
+		if dagList, err = api.getAllDags(ctx, nil); err != nil {
+			return []Finding{{Dimension: "inventory", Status: errorState(err), Message: fmt.Sprintf("could not retrieve DAGs: %v", err)}}
+		}
+	}
+
+	loaded := make([]string, 0, len(dagList.Dags))
+	var untracked []string
+	for _, dag := range dagList.Dags {
+		loaded = append(loaded, dag.DagId)
+		if !contains(manifest, dag.DagId) {
+			untracked = append(untracked, dag.DagId)
+		}
+	}
+
+	var undeployed []string
+	for _, dagId := range manifest {
+		if !contains(loaded, dagId) {
+			undeployed = append(undeployed, dagId)
+		}
+	}
+
+	findings := []Finding{}
+	if len(untracked) > 0 {
+		findings = append(findings, Finding{
+			Dimension: "inventory",
+			Status:    checkStates[plugin.UntrackedState],
+			Message:   fmt.Sprintf("DAGs not declared in the manifest: %s", strings.Join(untracked, ", ")),
+		})
+	}
+	if len(undeployed) > 0 {
+		findings = append(findings, Finding{
+			Dimension: "inventory",
+			Status:    checkStates[plugin.UndeployedState],
+			Message:   fmt.Sprintf("DAGs declared in the manifest but not loaded: %s", strings.Join(undeployed, ", ")),
+		})
+	}
+	if len(findings) == 0 {
+		findings = append(findings, Finding{Dimension: "inventory", Status: sensu.CheckStateOK})
+	}
+	return findings
+}
+
+// checkInstanceHealth reports the health of the metadatabase and the
+// scheduler, as seen by the airflow webserver.
+func checkInstanceHealth(ctx context.Context, api *apiClient) Finding {
+	finding := Finding{Dimension: "health", Status: sensu.CheckStateOK}
+
+	health, err := getInstanceHealth(ctx, api)
+	if err != nil {
+		finding.Status = errorState(err)
+		finding.Message = fmt.Sprintf("could not retrieve airflow health: %v", err)
+		return finding
+	}
+
+	var unhealthy []string
+	if health.MetaDatabase.Status != "healthy" {
+		unhealthy = append(unhealthy, "metadatabase")
+	}
+	if health.Scheduler.Status != "healthy" {
+		unhealthy = append(unhealthy, "scheduler")
+	}
+
+	if len(unhealthy) > 0 {
+		finding.Status = sensu.CheckStateCritical
+		finding.Message = fmt.Sprintf("Airflow components are not healthy: %s", strings.Join(unhealthy, ", "))
+	}
+	return finding
+}
+
+// importErrorLimit is the maximum length of the error reported for each file
+// that failed to import.
+const importErrorLimit = 200
+
+// checkPoolSlots verifies that a pool has open slots left, as DAG runs queue
+// indefinitely on a saturated pool.
+func checkPoolSlots(ctx context.Context, name string, api *apiClient) Finding {
+	finding := Finding{Dimension: "pools", Status: sensu.CheckStateOK}
+
+	pool, err := getPool(ctx, name, api)
+	if err != nil {
+		finding.Status = errorState(err)
+		finding.Message = fmt.Sprintf("could not retrieve pool %s: %v", name, err)
+	} else if pool == nil {
+		finding.Status = sensu.CheckStateWarning
+		finding.Message = fmt.Sprintf("Pool does not exist: %s", name)
+	} else if pool.OpenSlots == 0 || pool.OpenSlots < plugin.PoolMinSlots {
+		finding.Status = sensu.CheckStateWarning
+		finding.Message = fmt.Sprintf("Pool has %d open slots out of %d, %d occupied: %s", pool.OpenSlots, pool.Slots, pool.OccupiedSlots, name)
+	}
+	return finding
+}
+
+// checkDagCount verifies that enough DAGs are about to be checked, as filters
+// or a broken scheduler can silently narrow them down.
+func checkDagCount(count int) Finding {
+	finding := Finding{Dimension: "inventory", Status: sensu.CheckStateOK}
+	if count < plugin.MinDagCount {
+		finding.Status = sensu.CheckStateCritical
+		finding.Message = fmt.Sprintf("Only %d DAGs to check, expected at least %d", count, plugin.MinDagCount)
+	}
+	return finding
+}
+
+type Connection struct {
+	ConnectionId string `json:"connection_id"`
+	ConnType     string `json:"conn_type"`
+	Host         string `json:"host"`
+}
+
+func getConnection(ctx context.Context, connId string, api *apiClient) (*Connection, error) {
+	var result Connection
+	if err := api.get(ctx, "/connections/"+url.PathEscape(connId), nil, &result); isStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// checkConnection verifies that a connection required by the DAGs exists.
+func checkConnection(ctx context.Context, connId string, api *apiClient) Finding {
+	finding := Finding{Dimension: "connections", Status: sensu.CheckStateOK}
+
+	connection, err := getConnection(ctx, connId, api)
+	if err != nil {
+		finding.Status = errorState(err)
+		finding.Message = fmt.Sprintf("could not retrieve connection %s: %v", connId, err)
+	} else if connection == nil {
+		finding.Status = sensu.CheckStateCritical
+		finding.Message = fmt.Sprintf("Connection does not exist: %s", connId)
+	}
+	return finding
+}
+
+type DatasetEvent struct {
+	DatasetUri string     `json:"dataset_uri"`
+	Timestamp  *time.Time `json:"timestamp"`
+}
+
+type DatasetEventList struct {
+	DatasetEvents []DatasetEvent `json:"dataset_events"`
+	TotalEntries  int            `json:"total_entries"`
+}
+
+// getLatestDatasetEvent returns the most recent update of a dataset, or nil if
+// it was never updated.
+func getLatestDatasetEvent(ctx context.Context, uri string, api *apiClient) (*DatasetEvent, error) {
+	query := url.Values{"uri": {uri}, "order_by": {"-timestamp"}, "limit": {"1"}}
+
+	var result DatasetEventList
+	if err := api.get(ctx, "/datasets/events", query, &result); err != nil {
+		return nil, err
+	} else if len(result.DatasetEvents) == 0 {
+		return nil, nil
+	}
+	return &result.DatasetEvents[0], nil
+}
+
+// checkDataset verifies that a dataset produced by the DAGs was updated
+// recently.
+func checkDataset(ctx context.Context, uri string, api *apiClient) Finding {
+	finding := Finding{Dimension: "datasets", Status: sensu.CheckStateOK}
+	maxAge := time.Duration(plugin.DatasetMaxAge) * time.Second
+
+	event, err := getLatestDatasetEvent(ctx, uri, api)
+	if err != nil {
+		finding.Status = errorState(err)
+		finding.Message = fmt.Sprintf("could not retrieve events of dataset %s: %v", uri, err)
+	} else if event == nil || event.Timestamp == nil {
+		finding.Status = sensu.CheckStateWarning
+		finding.Message = fmt.Sprintf("Dataset was never updated: %s", uri)
+	} else if age := time.Since(*event.Timestamp); age > maxAge {
+		finding.Status = sensu.CheckStateWarning
+		finding.Message = fmt.Sprintf("Dataset last updated %s ago, exceeds dataset-max-age %s: %s", age.Round(time.Second), maxAge, uri)
+	}
+	return finding
+}
+
+// checkImportErrors reports the DAG files that failed to import, which never
+// show up as DAGs.
+func checkImportErrors(ctx context.Context, api *apiClient) Finding {
+	finding := Finding{Dimension: "import-errors", Status: sensu.CheckStateOK}
+
+	importErrors, err := getImportErrors(ctx, api)
+	if err != nil {
+		finding.Status = errorState(err)
+		finding.Message = fmt.Sprintf("could not retrieve import errors: %v", err)
+		return finding
+	} else if importErrors.TotalEntries == 0 {
+		return finding
+	}
+
+	lines := []string{fmt.Sprintf("%d DAG files failed to import:", importErrors.TotalEntries)}
+	for _, ie := range importErrors.ImportErrors {
+		lines = append(lines, fmt.Sprintf("%s: %s", ie.Filename, summarizeStackTrace(ie.StackTrace)))
+	}
+
+	finding.Status = sensu.CheckStateCritical
+	finding.Message = strings.Join(lines, "\n")
+	return finding
+}
+
+// summarizeStackTrace returns the last line of the stack trace, which holds
+// the error, truncated to the import error limit.
+func summarizeStackTrace(stackTrace string) string {
+	lines := strings.Split(strings.TrimSpace(stackTrace), "\n")
+	summary := strings.TrimSpace(lines[len(lines)-1])
+	if len(summary) > importErrorLimit {
+		summary = summary[:importErrorLimit] + "..."
+	}
+	return summary
+}
+
+// checkRunRate compares the number of DAG runs started across all DAGs
+// within the rate window against the expected minimum rate.
+func checkRunRate(ctx context.Context, api *apiClient) Finding {
+	finding := Finding{Dimension: "scheduler", Status: sensu.CheckStateOK}
+	window := time.Duration(plugin.RunRateWindow) * time.Second
+
+	filter := DagRunFilter{
+		StartDateGte: time.Now().Add(-window).UTC().Format(time.RFC3339),
+		PageLimit:    1,
+	}
+
+	dagRuns, err := listDagRuns(ctx, filter, api)
+	if err != nil {
+		finding.Status = errorState(err)
+		finding.Message = fmt.Sprintf("could not retrieve DAG runs: %v", err)
+		return finding
+	}
+
+	rate := float64(dagRuns.TotalEntries) / window.Minutes()
+	if rate < plugin.MinRunsPerMinute {
+		finding.Status = sensu.CheckStateWarning
+		finding.Message = fmt.Sprintf("DAG run creation rate of %.2f/min is below the minimum of %.2f/min", rate, plugin.MinRunsPerMinute)
+	}
+
+	return finding
+}
+
+func parseDagOrder(order string) []string {
+	var dags []string
+	for _, d := range strings.Split(order, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			dags = append(dags, d)
+		}
+	}
+	return dags
+}
+
+// checkRunOrder verifies that the latest successful run of each DAG has a
+// logical date after the one of the DAG before it.
+func checkRunOrder(ctx context.Context, dags []string, api *apiClient) Finding {
+	finding := Finding{Dimension: "dependencies", Status: sensu.CheckStateOK}
+
+	var previous *DagRun
+	for i, dagId := range dags {
+		dagRun, err := getLatestSuccessfulDagRun(ctx, dagId, api)
+		if err != nil {
+			finding.Status = errorState(err)
+			finding.Message = fmt.Sprintf("could not retrieve DAG runs: %s\n%v", dagId, err)
+			return finding
+		}
+
+		if i > 0 && previous != nil && previous.ExecutionDate != nil {
+			if dagRun == nil || dagRun.ExecutionDate == nil || !dagRun.ExecutionDate.After(*previous.ExecutionDate) {
+				finding.Status = sensu.CheckStateWarning
+				finding.Message = fmt.Sprintf("DAG %s has no successful run after the latest successful run of %s", dagId, dags[i-1])
+				return finding
+			}
+		}
+		previous = dagRun
+	}
+
+	return finding
+}
+
+// errorState returns the state of a finding whose request failed, a warning
+// when the request budget was exhausted since that says nothing of airflow.
+func errorState(err error) int {
+	if errors.Is(err, errRequestBudget) {
+		return sensu.CheckStateWarning
+	}
+	return sensu.CheckStateCritical
+}
+
+func worstState(a int, b int) int {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+func stateName(status int) string {
+	for _, name := range checkStateNames {
+		if checkStates[name] == status {
+			return strings.ToUpper(name)
+		}
+	}
+	return "UNKNOWN"
+}
+
+// checkFailedInWindow issues a single query for DAG runs that failed within
+// the configured window across all DAGs, or the explicitly listed ones.
+func checkFailedInWindow(ctx context.Context, w io.Writer, api *apiClient) (int, *Summary, error) {
+	filter := DagRunFilter{
+		DagIds:     plugin.Dags,
+		States:     plugin.FailStates,
+		EndDateGte: time.Now().Add(-time.Duration(plugin.AnyFailedWithin) * time.Second).UTC().Format(time.RFC3339),
+	}
+
+	dagRuns, err := listDagRuns(ctx, filter, api)
+	if errors.Is(err, errRequestBudget) {
+		return budgetExceeded(w, "before the failed DAG runs were retrieved")
+	} else if err != nil {
+		return sensu.CheckStateCritical, nil, fmt.Errorf("could not retrieve failed DAG runs: %v", err)
+	}
+
+	if dagRuns.TotalEntries == 0 {
+		fmt.Fprintf(w, "No DAG runs failed in the last %ds\n", plugin.AnyFailedWithin)
+		return sensu.CheckStateOK, nil, nil
+	}
+
+	fmt.Fprintf(w, "%d DAG runs failed in the last %ds\n", dagRuns.TotalEntries, plugin.AnyFailedWithin)
+	for _, r := range dagRuns.DagRuns {
+		fmt.Fprintf(w, "%s %s FAILED\n", r.DagId, r.DagRunId)
+	}
+
+	return sensu.CheckStateCritical, nil, nil
+}
+
+// redactHealth replaces the DAG IDs in the health results with a stable hash,
+// optionally recording the mapping in a file readable only by the owner.
+func redactHealth(health []Health) error {
+	mapping := make(map[string]string, len(health))
+
+	for i, h := range health {
+		redacted := redactDagId(h.DagId)
+		mapping[redacted] = h.DagId
+		if h.Error != nil {
+			health[i].Error = errors.New(strings.ReplaceAll(h.Error.Error(), h.DagId, redacted))
+		}
+		health[i].DagId = redacted
+	}
+
+	if plugin.RedactMapFile == "" {
+		return nil
+	}
+
+	body, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(plugin.RedactMapFile, body, 0600)
+}
+
+func redactDagId(dagId string) string {
+	sum := sha256.Sum256([]byte(dagId))
+	return "dag-" + hex.EncodeToString(sum[:6])
+}
+
+// printCheckResult runs the check and prints the outcome as a Sensu event
+// that can be posted to the agent events API.
+func printCheckResult() (int, error) {
+	var output bytes.Buffer
+	status, summary, err := checkDagHealth(&output)
+	if err != nil {
+		fmt.Fprintf(&output, "%v\n", err)
+	}
+	if plugin.Heartbeat {
+		printHeartbeat(&output)
+	}
+
+	result, err := newCheckResult(status, output.String(), summary)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("failed to encode check result: %v", err)
+	}
+
+	fmt.Println(string(body))
+	return status, nil
+}
+
+func newCheckResult(status int, output string, summary *Summary) (*corev2.Event, error) {
+	now := time.Now()
+
+	check := corev2.Check{
+		ObjectMeta: corev2.NewObjectMeta(plugin.Name, ""),
+		Status:     uint32(status),
+		Output:     output,
+		Executed:   now.Unix(),
+	}
+	if err := check.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid check result: %v", err)
+	}
+
+	result := &corev2.Event{Check: &check}
+
+	if summary != nil {
+		counts := []struct {
+			name  string
+			value int
+		}{
+			{"oks", summary.Oks},
+			{"warnings", summary.Warnings},
+			{"criticals", summary.Criticals},
+			{"unknowns", summary.Unknowns},
+			{"paused", summary.Paused},
+		}
+		result.Metrics = &corev2.Metrics{}
+		for _, c := range counts {
+			result.Metrics.Points = append(result.Metrics.Points, &corev2.MetricPoint{
+				Name:      "airflow_dag_check." + c.name,
+				Value:     float64(c.value),
+				Timestamp: now.Unix(),
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// printOpenMetrics runs the check and prints the health of each DAG in the
+// OpenMetrics text format.
+func printOpenMetrics() (int, error) {
+	status, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		return status, err
+	}
+
+	fmt.Print(formatOpenMetrics(summary))
+	return status, nil
+}
+
+// formatOpenMetrics renders the DAG health, the state of the instance checks
+// and the heartbeat as OpenMetrics gauges, each sample being a state at the
+// time of the check rather than a count.
+func formatOpenMetrics(summary *Summary) string {
+	var b strings.Builder
+
+	b.WriteString("# TYPE airflow_dag_up gauge\n")
+	b.WriteString("# HELP airflow_dag_up Whether the DAG is healthy.\n")
+	if summary != nil {
+		for _, h := range summary.Dags {
+			up := 0
+			if h.Status == sensu.CheckStateOK {
+				up = 1
+			}
+			fmt.Fprintf(&b, "airflow_dag_up{dag_id=\"%s\"} %d\n", escapeLabelValue(h.DagId), up)
+		}
+	}
+
+	b.WriteString("# TYPE airflow_dag_run_failed gauge\n")
+	b.WriteString("# HELP airflow_dag_run_failed Whether the evaluated DAG run failed.\n")
+	if summary != nil {
+		for _, h := range summary.Dags {
+			failed := 0
+			if isFailedState(h.DagId, h.RunState) {
+				failed = 1
+			}
+			fmt.Fprintf(&b, "airflow_dag_run_failed{dag_id=\"%s\",dag_run_id=\"%s\"} %d\n", escapeLabelValue(h.DagId), escapeLabelValue(h.DagRunId), failed)
+		}
+	}
+
+	// a dimension may hold several findings, e.g. one per connection
+	var dimensions []string
+	states := map[string]int{}
+	if summary != nil {
+		for _, f := range summary.Findings {
+			if _, ok := states[f.Dimension]; !ok {
+				dimensions = append(dimensions, f.Dimension)
+			}
+			states[f.Dimension] = worstState(states[f.Dimension], f.Status)
+		}
+	}
+	if len(dimensions) > 0 {
+		b.WriteString("# TYPE airflow_check_state gauge\n")
+		b.WriteString("# HELP airflow_check_state Worst state of the instance checks of the dimension, 0 ok, 1 warning, 2 critical or 3 unknown.\n")
+		for _, dimension := range dimensions {
+			fmt.Fprintf(&b, "airflow_check_state{dimension=\"%s\"} %d\n", escapeLabelValue(dimension), states[dimension])
+		}
+	}
+
+	if plugin.Heartbeat {
+		b.WriteString("# TYPE airflow_check_heartbeat_timestamp_seconds gauge\n")
+		b.WriteString("# HELP airflow_check_heartbeat_timestamp_seconds Time the check last ran.\n")
+		fmt.Fprintf(&b, "airflow_check_heartbeat_timestamp_seconds %d\n", time.Now().Unix())
+	}
+
+	b.WriteString("# EOF\n")
+	return b.String()
+}
+
+// formatTextfile renders the DAG health in the prometheus text format read by
+// the textfile collector of node_exporter.
+func formatTextfile(summary *Summary) string {
+	var b strings.Builder
+
+	b.WriteString("# HELP airflow_dag_up Whether the DAG is healthy.\n")
+	b.WriteString("# TYPE airflow_dag_up gauge\n")
+	for _, h := range summary.Dags {
+		up := 0
+		if h.Status == sensu.CheckStateOK {
+			up = 1
+		}
+		fmt.Fprintf(&b, "airflow_dag_up{dag_id=\"%s\"} %d\n", escapeLabelValue(h.DagId), up)
+	}
+
+	b.WriteString("# HELP airflow_dags Number of DAGs checked per state.\n")
+	b.WriteString("# TYPE airflow_dags gauge\n")
+	fmt.Fprintf(&b, "airflow_dags{state=\"ok\"} %d\n", summary.Oks)
+	fmt.Fprintf(&b, "airflow_dags{state=\"warning\"} %d\n", summary.Warnings)
+	fmt.Fprintf(&b, "airflow_dags{state=\"critical\"} %d\n", summary.Criticals)
+	fmt.Fprintf(&b, "airflow_dags{state=\"unknown\"} %d\n", summary.Unknowns)
+	fmt.Fprintf(&b, "airflow_dags{state=\"paused\"} %d\n", summary.Paused)
+
+	return b.String()
+}
+
+// writeTextfile replaces the textfile atomically, so the collector never
+// reads a partially written file.
+func writeTextfile(path string, summary *Summary) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(formatTextfile(summary)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// healthResult is the JSON representation of the health of a DAG.
+type healthResult struct {
+	DagId  string `json:"dag_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type findingResult struct {
+	Dimension string `json:"dimension"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+}
+
+// jsonResult is the result of the check printed by --output json, holding
+// what the text output prints: its state and lines, the DAGs, the instance
+// findings and the heartbeat.
+type jsonResult struct {
+	Status    string          `json:"status"`
+	Output    string          `json:"output"`
+	Dags      []healthResult  `json:"dags"`
+	Findings  []findingResult `json:"findings"`
+	Heartbeat string          `json:"heartbeat,omitempty"`
+}
+
+func printJSON(w io.Writer) (int, error) {
+	var output bytes.Buffer
+	status, summary, err := writeText(&output, plugin, newRequestBudget(plugin.MaxTotalRequests))
+	if err != nil {
+		return status, err
+	}
+
+	result := jsonResult{
+		Status:   strings.ToLower(stateName(status)),
+		Output:   output.String(),
+		Dags:     []healthResult{},
+		Findings: []findingResult{},
+	}
+	if summary != nil {
+		for _, h := range summary.Dags {
+			dag := healthResult{DagId: h.DagId, Status: strings.ToLower(stateName(h.Status))}
+			if h.Error != nil {
+				dag.Error = h.Error.Error()
+			}
+			result.Dags = append(result.Dags, dag)
+		}
+		for _, f := range summary.Findings {
+			result.Findings = append(result.Findings, findingResult{Dimension: f.Dimension, Status: strings.ToLower(stateName(f.Status)), Message: f.Message})
+		}
+	}
+	if plugin.Heartbeat {
+		result.Heartbeat = formatHeartbeat()
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("failed to encode results: %v", err)
+	}
+
+	fmt.Fprintln(w, string(body))
+	return status, nil
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+type Health struct {
+	DagId    string
+	DagRunId string
+	RunState string
+	Status   int
+	Error    error
+	Duration time.Duration
+	Paused   bool
+}
+
+// checkDags checks each DAG in turn, stopping early when authentication
+// fails or airflow is in maintenance since no further request can succeed.
+func checkDags(ctx context.Context, dags []string, explicit bool, api *apiClient) ([]Health, error) {
+	var result []Health
+
+	for _, dagId := range dags {
+		if ctx.Err() != nil {
+			result = append(result, Health{
+				DagId:  dagId,
+				Status: sensu.CheckStateUnknown,
+				Error:  fmt.Errorf("check timed out before checking this DAG: %s", dagId),
+			})
+			continue
+		} else if !api.budget.left() {
+			result = append(result, Health{
+				DagId:  dagId,
+				Status: sensu.CheckStateUnknown,
+				Error:  fmt.Errorf("%w before checking this DAG: %s", errRequestBudget, dagId),
+			})
+			continue
+		}
+
+		started := time.Now()
+		refused := api.budget.refusals()
+		health := checkDagWithTimeout(ctx, dagId, explicit, api)
+		health.Duration = time.Since(started)
+		if api.budget.refusals() > refused && health.Status != sensu.CheckStateOK {
+			// the failure may only be the refused request
+			health.Status = sensu.CheckStateUnknown
+			health.Error = fmt.Errorf("%w while checking this DAG: %s", errRequestBudget, dagId)
+		}
+		if plugin.AlertNewFailures {
+			trackFailure(&health)
+		}
+		debugf("dag %s latest run state=%s -> %s", dagId, describeRunState(health.RunState), stateName(health.Status))
+		if isAuthFailure(health.Error) {
+			return result, errAuthFailed
+		} else if isMaintenance(health.Error) {
+			return result, errMaintenance
+		}
+		result = append(result, health)
+
+		if plugin.FailFast && health.Status == sensu.CheckStateCritical {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// checkDagWithTimeout checks a single DAG, giving it its own deadline when a
+// per-DAG timeout is configured. A DAG whose check is interrupted by either
+// deadline is unknown.
+func checkDagWithTimeout(ctx context.Context, dagId string, explicit bool, api *apiClient) Health {
+	if plugin.PerDagTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plugin.PerDagTimeout)*time.Second)
+		defer cancel()
+	}
+
+	health := checkDag(ctx, dagId, explicit, api)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		health.Error = fmt.Errorf("check timed out for this DAG: %s", dagId)
+		health.Status = sensu.CheckStateUnknown
+	}
+
+	return health
+}
+
+// failedState returns the state of a failed DAG, critical unless overridden
+// with --dag-severity or --tag-severity, or downgraded with
+// --downgrade-failures.
+func failedState(dag *Dag) int {
+	if state, ok := plugin.DagSeverity[dag.DagId]; ok {
+		return checkStates[state]
+	}
+
+	status, found := sensu.CheckStateOK, false
+	for _, tag := range dag.Tags {
+		if state, ok := plugin.TagSeverity[tag.Name]; ok {
+			status, found = worstState(status, checkStates[state]), true
+		}
+	}
+
+	if found {
+		return status
+	} else if plugin.DowngradeFailures {
+		return sensu.CheckStateWarning
+	}
+	return sensu.CheckStateCritical
+}
+
+// unexpectedState returns the state of a DAG whose run completed in a state
+// that is neither ok nor failed, critical when failures are downgraded.
+func unexpectedState() int {
+	if plugin.DowngradeFailures {
+		return sensu.CheckStateCritical
+	}
+	return sensu.CheckStateUnknown
+}
+
+func checkDag(ctx context.Context, dagId string, explicit bool, api *apiClient) Health {
+	health := Health{DagId: dagId, Status: sensu.CheckStateOK}
+
+	dag, err := api.getDag(ctx, dagId)
+	if err == errDagNotFound && explicit {
+		health.Error = fmt.Errorf("requested DAG '%s' not found on server", dagId)
+		health.Status = checkStates[plugin.NotFoundState]
+		return health
+	} else if err == errDagNotFound {
+		health.Error = fmt.Errorf("DAG does not exist: %s", dagId)
+		health.Status = checkStates[plugin.NotFoundState]
+		return health
+	} else if dag == nil {
+		health.Error = fmt.Errorf("could not retrieve DAG: %s\n%w", dagId, err)
+		health.Status = sensu.CheckStateCritical
+		return health
+	}
+
+	if (explicit || plugin.WarnOnPaused) && dag.IsPaused {
+		health.Error = fmt.Errorf("DAG is paused and will not process: %s", dagId)
+		health.Status = checkStates[plugin.PausedState]
+		health.Paused = true
+		return health
+	}
+
+	if plugin.WarnOnNoSchedule && !dag.IsPaused && dag.ScheduleInterval == nil {
+		health.Error = fmt.Errorf("DAG has no schedule and only runs when triggered: %s", dagId)
+		health.Status = sensu.CheckStateWarning
+		return health
+	}
+
+	var dagRun *DagRun
+	if plugin.DagRunId != "" {
+		dagRun, err = getDagRunById(ctx, dagId, plugin.DagRunId, api)
+		if err == errDagRunNotFound {
+			health.Error = fmt.Errorf("DAG run does not exist: %s %s", dagId, plugin.DagRunId)
+			health.Status = sensu.CheckStateCritical
+			return health
+		}
+	} else if plugin.LatestPerType {
+		var runs []DagRun
+		runs, err = getLatestDagRunPerType(ctx, dagId, api)
+
+		for _, r := range runs {
+			if isFailedState(dagId, r.State) {
+				health.DagRunId = r.DagRunId
+				health.RunState = r.State
+				health.Error = fmt.Errorf("DAG failed its last %s execution: %s%s (%s)%s", r.RunType, dagId, describeRun(&r), describeRunTypes(runs), failureReason(ctx, dagId, &r, api))
+				health.Status = failedState(dag)
+				return health
+			}
+		}
+		if len(runs) > 0 {
+			dagRun = &runs[0]
+		}
+	} else {
+		dagRun, err = api.getLatestDagRun(ctx, dagId)
+
+		if err == nil && plugin.WaitCompletion && dagRun != nil && isActiveState(dagRun.State) {
+			dagRun, err = waitForDagRun(ctx, dagId, api)
+		}
+	}
+
+	if dagRun != nil {
+		health.DagRunId = dagRun.DagRunId
+		health.RunState = dagRun.State
+	}
+
+	failures := 0
+	if err == nil && dagRun != nil && isFailedState(dagId, dagRun.State) {
+		failures = 1
+		if plugin.FailureThreshold > 1 && plugin.DagRunId == "" {
+			failures, err = consecutiveFailures(ctx, dagId, api)
+		}
+	}
+
+	if err == errWaitTimeout {
+		health.Error = fmt.Errorf("timed out waiting for DAG run to complete: %s", dagId)
+		health.Status = sensu.CheckStateUnknown
+		return health
+	} else if err != nil {
+		// the state of the DAG is not known, unlike a DAG that never ran
+		health.Error = fmt.Errorf("could not retrieve DAG runs: %s\n%w", dagId, err)
+		health.Status = sensu.CheckStateUnknown
+		return health
+	} else if dagRun == nil && plugin.Since > 0 {
+		health.Error = fmt.Errorf("no run in the last %s: %s", time.Duration(plugin.Since)*time.Second, dagId)
+		health.Status = sensu.CheckStateWarning
+		return health
+	} else if failures > 0 && failures >= plugin.FailureThreshold {
+		if failures > 1 {
+			health.Error = fmt.Errorf("DAG failed its last %d executions: %s%s%s", failures, dagId, describeRun(dagRun), failureReason(ctx, dagId, dagRun, api))
+		} else {
+			health.Error = fmt.Errorf("DAG failed its last execution: %s%s%s", dagId, describeRun(dagRun), failureReason(ctx, dagId, dagRun, api))
+		}
+		health.Status = failedState(dag)
+		return health
+	} else if dagRun != nil && !isActiveState(dagRun.State) && !isFailedState(dagId, dagRun.State) && !contains(okStates(dagId), dagRun.State) {
+		health.Error = fmt.Errorf("DAG run ended in state %s, neither an ok nor a fail state: %s%s", dagRun.State, dagId, describeRun(dagRun))
+		health.Status = unexpectedState()
+		return health
+	} else if dagRun != nil && dagRun.State == "running" && plugin.DetectStalled {
+		stalled, err := checkProgress(ctx, dagId, dagRun, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve task instances: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		} else if stalled {
+			health.Error = fmt.Errorf("DAG run shows no task progress since the last check: %s %s", dagId, dagRun.DagRunId)
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	} else if dagRun != nil && dagRun.EndDate != nil && plugin.CheckZombies {
+		zombies, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, []string{"running"}, 100, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve task instances: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		} else if zombies.TotalEntries > 0 {
+			health.Error = fmt.Errorf("DAG run ended with %d tasks still running: %s %s (%s)", zombies.TotalEntries, dagId, dagRun.DagRunId, strings.Join(taskIds(zombies.TaskInstances), ", "))
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if dagRun != nil && !isFailedState(dagId, dagRun.State) && plugin.CheckTasks {
+		failed, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, []string{"failed", "upstream_failed"}, 100, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve task instances: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		} else if failed.TotalEntries > 0 {
+			health.Error = fmt.Errorf("DAG run is %s with %d failed tasks: %s %s (%s)", dagRun.State, failed.TotalEntries, dagId, dagRun.DagRunId, strings.Join(taskIds(failed.TaskInstances), ", "))
+			health.Status = failedState(dag)
+			return health
+		}
+	}
+
+	if dagRun != nil && plugin.CheckSla {
+		misses, err := getSlaMisses(ctx, dagId, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve SLA misses: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		} else if tasks := missedSla(misses.SlaMisses, dagRun); len(tasks) > 0 {
+			health.Error = fmt.Errorf("DAG run missed the SLA of %d tasks: %s %s (%s)", len(tasks), dagId, dagRun.DagRunId, strings.Join(tasks, ", "))
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if dagRun != nil && isActiveState(dagRun.State) && plugin.MaxRunDuration > 0 {
+		maxDuration := time.Duration(plugin.MaxRunDuration) * time.Second
+		if since := activeSince(dagRun); since != nil && time.Since(*since) > maxDuration {
+			health.Error = fmt.Errorf("DAG run has been %s for %s, exceeds max-run-duration %s: %s %s", dagRun.State, time.Since(*since).Round(time.Second), maxDuration, dagId, dagRun.DagRunId)
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if dagRun != nil && isActiveState(dagRun.State) && plugin.MaxTaskQueuedAge > 0 {
+		queued, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, []string{"queued"}, 100, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve task instances: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		}
+
+		maxAge := time.Duration(plugin.MaxTaskQueuedAge) * time.Second
+		var stuck []string
+		for _, t := range queued.TaskInstances {
+			if t.QueuedWhen != nil && time.Since(*t.QueuedWhen) > maxAge {
+				stuck = append(stuck, t.TaskId)
+			}
+		}
+		if len(stuck) > 0 {
+			health.Error = fmt.Errorf("DAG run has tasks queued for longer than %s: %s %s (%s)", maxAge, dagId, dagRun.DagRunId, strings.Join(stuck, ", "))
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if dagRun != nil && plugin.MaxRetries > 0 {
+		tasks, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, nil, 100, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve task instances: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		}
+
+		// the first try is not a retry
+		var retrying []string
+		for _, t := range tasks.TaskInstances {
+			if t.State != "success" && t.TryNumber-1 > plugin.MaxRetries {
+				retrying = append(retrying, fmt.Sprintf("%s %d retries", t.TaskId, t.TryNumber-1))
+			}
+		}
+		if len(retrying) > 0 {
+			health.Error = fmt.Errorf("DAG run has tasks retried more than %d times: %s %s (%s)", plugin.MaxRetries, dagId, dagRun.DagRunId, strings.Join(retrying, ", "))
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if expected, ok := plugin.ExpectTaskCount[dagId]; ok && dagRun != nil && !isActiveState(dagRun.State) {
+		tasks, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, nil, 1, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve task instances: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		}
+
+		deviation := tasks.TotalEntries - expected
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		if deviation > plugin.TaskCountTolerance {
+			health.Error = fmt.Errorf("DAG run has %d task instances, expected %d: %s %s", tasks.TotalEntries, expected, dagId, dagRun.DagRunId)
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if ran := lastRan(dagRun); plugin.MaxAge > 0 && ran != nil && time.Since(*ran) > time.Duration(plugin.MaxAge)*time.Second {
+		health.Error = fmt.Errorf("DAG last ran %s ago, exceeds max-age %s: %s", time.Since(*ran).Round(time.Second), time.Duration(plugin.MaxAge)*time.Second, dagId)
+		health.Status = sensu.CheckStateWarning
+		return health
+	}
+
+	if lag := intervalLag(dagRun); plugin.MaxIntervalLag > 0 && lag > time.Duration(plugin.MaxIntervalLag)*time.Second {
+		health.Error = fmt.Errorf("DAG run completed %s after the end of its data interval: %s %s", lag.Round(time.Second), dagId, dagRun.DagRunId)
+		health.Status = sensu.CheckStateWarning
+		return health
+	} else if dagRun == nil && plugin.WarnNoRuns && !dag.IsPaused {
+		health.Error = fmt.Errorf("DAG is active but has never run: %s", dagId)
+		health.Status = sensu.CheckStateWarning
+		return health
+	} else if dagRun == nil && plugin.RequireRuns && explicit {
+		health.Error = fmt.Errorf("DAG has never run: %s", dagId)
+		health.Status = sensu.CheckStateWarning
+		return health
+	}
+
+	if plugin.MinRuns > 0 && !dag.IsPaused {
+		runs, err := api.getDagRuns(ctx, dagId, 1, 0, nil)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve DAG runs: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		} else if runs.TotalEntries < plugin.MinRuns {
+			health.Error = fmt.Errorf("DAG ran %d times, expected at least %d: %s", runs.TotalEntries, plugin.MinRuns, dagId)
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if contains(plugin.WarnCatchup, dagId) {
+		details, err := getDagDetails(ctx, dagId, api)
+		if err != nil {
+			health.Error = fmt.Errorf("could not retrieve DAG details: %s\n%w", dagId, err)
+			health.Status = sensu.CheckStateCritical
+			return health
+		} else if details.Catchup {
+			health.Error = fmt.Errorf("DAG has catchup enabled: %s", dagId)
+			health.Status = sensu.CheckStateWarning
+			return health
+		}
+	}
+
+	if missing := missingTags(dag, plugin.RequiredTags); len(missing) > 0 {
+		health.Error = fmt.Errorf("DAG is missing required tags: %s (%s)", dagId, strings.Join(missing, ", "))
+		health.Status = sensu.CheckStateWarning
+		return health
+	}
+
+	return health
+}
+
+type InstanceHealth struct {
+	MetaDatabase ComponentHealth `json:"metadatabase"`
+	Scheduler    ComponentHealth `json:"scheduler"`
+}
+
+type ComponentHealth struct {
+	Status string `json:"status"`
+}
+
+func getInstanceHealth(ctx context.Context, api *apiClient) (*InstanceHealth, error) {
+	var result InstanceHealth
+	if err := api.get(ctx, "/health", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type ImportError struct {
+	Filename   string `json:"filename"`
+	StackTrace string `json:"stack_trace"`
+}
+
+type ImportErrorList struct {
+	ImportErrors []ImportError `json:"import_errors"`
+	TotalEntries int           `json:"total_entries"`
+}
+
+func getImportErrors(ctx context.Context, api *apiClient) (*ImportErrorList, error) {
+	var result ImportErrorList
+	if err := api.get(ctx, "/importErrors", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type Dag struct {
+	DagId            string            `json:"dag_id"`
+	IsPaused         bool              `json:"is_paused"`
+	Tags             []Tag             `json:"tags"`
+	ScheduleInterval *ScheduleInterval `json:"schedule_interval"`
+	// only returned by the DAG details endpoint
+	Catchup bool `json:"catchup"`
+}
+
+// ScheduleInterval is the schedule of a DAG, null for DAGs that are only
+// triggered manually or externally.
+type ScheduleInterval struct {
+	Type  string `json:"__type"`
+	Value string `json:"value"`
+}
+
+type Tag struct {
+	Name string `json:"name"`
+}
+
+func missingTags(dag *Dag, required []string) []string {
+	var missing []string
+	for _, r := range required {
+		found := false
+		for _, t := range dag.Tags {
+			if t.Name == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// getDag retrieves the DAG, errDagNotFound when the API does not know it.
+func (a *apiClient) getDag(ctx context.Context, dagId string) (*Dag, error) {
+	if dag, ok := a.dags[dagId]; ok {
+		return dag, nil
+	}
+
+	var result Dag
+	if err := a.get(ctx, dagPath(dagId), nil, &result); isStatus(err, http.StatusNotFound) {
+		return nil, errDagNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if a.dags != nil {
+		a.dags[dagId] = &result
+	}
+	return &result, nil
+}
+
+func getDagDetails(ctx context.Context, dagId string, api *apiClient) (*Dag, error) {
+	var result Dag
+	if err := api.get(ctx, dagPath(dagId, "details"), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type Task struct {
+	TaskId string `json:"task_id"`
+	Pool   string `json:"pool"`
+}
+
+type TaskList struct {
+	Tasks        []Task `json:"tasks"`
+	TotalEntries int    `json:"total_entries"`
+}
+
+func getDagTasks(ctx context.Context, dagId string, api *apiClient) (*TaskList, error) {
+	var result TaskList
+	if err := api.get(ctx, dagPath(dagId, "tasks"), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// filterDagsByPool returns the DAGs having at least one task in the pool.
+func filterDagsByPool(ctx context.Context, dags []string, pool string, api *apiClient) ([]string, error) {
+	var result []string
+
+	for _, dagId := range dags {
+		tasks, err := getDagTasks(ctx, dagId, api)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dagId, err)
+		}
+
+		for _, t := range tasks.Tasks {
+			if t.Pool == pool {
+				result = append(result, dagId)
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+type Pool struct {
+	Name          string `json:"name"`
+	Slots         int    `json:"slots"`
+	OccupiedSlots int    `json:"occupied_slots"`
+	OpenSlots     int    `json:"open_slots"`
+}
+
+// getPool returns the pool, or nil if it does not exist.
+func getPool(ctx context.Context, name string, api *apiClient) (*Pool, error) {
+	var result Pool
+	if err := api.get(ctx, "/pools/"+url.PathEscape(name), nil, &result); isStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type DagList struct {
+	Dags         []Dag `json:"dags"`
+	TotalEntries int   `json:"total_entries"`
+}
+
+// dagPageLimit is the number of DAGs requested per page, the default page
+// size of the airflow API.
+const dagPageLimit = 100
+
+// getAllDags retrieves every DAG, following the pages of the DAG list until
+// all entries have been retrieved. When tags are given, only the DAGs having
+// at least one of them are retrieved.
+func (a *apiClient) getAllDags(ctx context.Context, filter url.Values) (*DagList, error) {
+	var result DagList
+
+	for {
+		page, err := a.getDagPage(ctx, len(result.Dags), filter)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Dags = append(result.Dags, page.Dags...)
+		result.TotalEntries = page.TotalEntries
+
+		if len(page.Dags) == 0 || len(result.Dags) >= result.TotalEntries {
+			return &result, nil
+		}
+	}
+}
+
+func getSlaMisses(ctx context.Context, dagId string, api *apiClient) (*SlaMissList, error) {
+	var result SlaMissList
+	if err := api.get(ctx, dagPath(dagId, "slaMisses"), url.Values{"limit": {"100"}}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *apiClient) getDagPage(ctx context.Context, offset int, filter url.Values) (*DagList, error) {
+	query := url.Values{}
+	for k, v := range filter {
+		query[k] = v
+	}
+	query.Set("limit", fmt.Sprint(dagPageLimit))
+	query.Set("offset", fmt.Sprint(offset))
+
+	var result DagList
+	if err := a.get(ctx, "/dags", query, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type DagRun struct {
+	DagId           string                 `json:"dag_id"`
+	DagRunId        string                 `json:"dag_run_id"`
+	RunType         string                 `json:"run_type"`
+	State           string                 `json:"state"`
+	ExecutionDate   *time.Time             `json:"execution_date"`
+	QueuedAt        *time.Time             `json:"queued_at"`
+	StartDate       *time.Time             `json:"start_date"`
+	EndDate         *time.Time             `json:"end_date"`
+	DataIntervalEnd *time.Time             `json:"data_interval_end"`
+	Note            string                 `json:"note"`
+	Conf            map[string]interface{} `json:"conf"`
+}
+
+// describeRun identifies a DAG run in messages by its ID and execution date, so
+// it can be looked up in the airflow UI.
+func describeRun(dagRun *DagRun) string {
+	if dagRun.ExecutionDate == nil {
+		return " run " + dagRun.DagRunId
+	}
+	return fmt.Sprintf(" run %s at %s", dagRun.DagRunId, dagRun.ExecutionDate.UTC().Format(time.RFC3339))
+}
+
+// intervalLag returns how long after the end of its data interval a DAG run
+// completed, or 0 if the run did not complete.
+func intervalLag(dagRun *DagRun) time.Duration {
+	if dagRun == nil || dagRun.EndDate == nil || dagRun.DataIntervalEnd == nil {
+		return 0
+	}
+	return dagRun.EndDate.Sub(*dagRun.DataIntervalEnd)
+}
+
+type DagRunList struct {
+	DagRuns      []DagRun `json:"dag_runs"`
+	TotalEntries int      `json:"total_entries"`
+}
+
+// latestRunsFilter orders the DAG runs from the most recent, restricted to the
+// window of --since when set.
+func (a *apiClient) latestRunsFilter() url.Values {
+	filter := url.Values{"order_by": {"-execution_date"}}
+	if a.since > 0 {
+		filter.Set("execution_date_gte", time.Now().Add(-a.since).UTC().Format(time.RFC3339))
+	}
+	return filter
+}
+
+// getLatestDagRun returns the most recent DAG run, or with --run-conf-match
+// the most recent one whose conf matches within the history limit. With
+// --skip-active-runs, the runs are paged through until a completed one.
+func (a *apiClient) getLatestDagRun(ctx context.Context, dagId string) (*DagRun, error) {
+	// a later call polls for a newer run
+	if dagRun, ok := a.latestRuns[dagId]; ok {
+		delete(a.latestRuns, dagId)
+		return dagRun, nil
+	}
+
+	limit := 1
+	if len(a.runConfMatch) > 0 || a.skipActiveRuns {
+		limit = a.historyLimit
+	}
+
+	var latest *DagRun
+	err := a.eachDagRun(ctx, dagId, limit, func(dagRun *DagRun) bool {
+		latest = dagRun
+		return false
+	})
+	return latest, err
+}
+
+// eachDagRun calls visit on the runs of the DAG from the most recent, as long
+// as it returns true, requesting them limit at a time. The runs are those of
+// the window of --since whose conf matches --run-conf-match. With
+// --skip-active-runs, the active runs are left out and the runs are paged
+// through past the first limit.
+func (a *apiClient) eachDagRun(ctx context.Context, dagId string, limit int, visit func(*DagRun) bool) error {
+	for offset := 0; ; offset += limit {
+		dagRuns, err := a.getDagRuns(ctx, dagId, limit, offset, a.latestRunsFilter())
+		if err != nil {
+			return err
+		}
+
+		for i := range dagRuns.DagRuns {
+			if a.skipActiveRuns && isActiveState(dagRuns.DagRuns[i].State) {
+				continue
+			} else if confMatches(dagRuns.DagRuns[i].Conf, a.runConfMatch) && !visit(&dagRuns.DagRuns[i]) {
+				return nil
+			}
+		}
+
+		if !a.skipActiveRuns || len(dagRuns.DagRuns) == 0 || offset+len(dagRuns.DagRuns) >= dagRuns.TotalEntries {
+			return nil
+		}
+	}
+}
+
+// graphqlDagsQuery retrieves the DAGs and their latest run, with the fields
+// named as in the REST API so that they decode into the same types.
+const graphqlDagsQuery = `query ($dagIds: [String!]!) {
+  dags(dagIds: $dagIds) {
+    dag_id is_paused tags { name } schedule_interval { value }
+    latest_dag_run {
+      dag_id dag_run_id run_type state execution_date queued_at start_date
+      end_date data_interval_end note conf
+    }
+  }
+}`
+
+type graphqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type graphqlDag struct {
+	Dag
+	LatestDagRun *DagRun `json:"latest_dag_run"`
+}
+
+type graphqlResponse struct {
+	Data struct {
+		Dags []graphqlDag `json:"dags"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// queryDags retrieves the DAGs and their latest run from the GraphQL endpoint
+// in a single request, memoizing them for the rest of the check. The latest
+// run is only kept when no option alters its selection. The DAGs the query
+// does not return, or all of them when it fails, are left to the REST API.
+// The credentials and headers of the REST API are only sent to an endpoint
+// on another host with sendCredentials.
+func (a *apiClient) queryDags(ctx context.Context, endpoint string, sendCredentials bool, dagIds []string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+
+	// the endpoint shares the budget of the REST API
+	graphql := *a
+	graphql.baseUrl = u.Scheme + "://" + u.Host
+	if api, err := url.Parse(a.baseUrl); err != nil || api.Scheme != u.Scheme || api.Host != u.Host {
+		if !sendCredentials {
+			graphql.creds = credentials{noAuth: true}
+			graphql.headers = nil
+		}
+	}
+	request := graphqlRequest{Query: graphqlDagsQuery, Variables: map[string]interface{}{"dagIds": dagIds}}
+
+	var result graphqlResponse
+	if err := graphql.send(ctx, "POST", u.Path, u.Query(), request, &result); err != nil {
+		return err
+	} else if len(result.Errors) > 0 {
+		return fmt.Errorf("GraphQL query failed: %s", result.Errors[0].Message)
+	}
+
+	latest := len(a.runConfMatch) == 0 && !a.skipActiveRuns && a.since == 0
+	if a.dags == nil {
+		a.dags = map[string]*Dag{}
+	}
+	if a.latestRuns == nil {
+		a.latestRuns = map[string]*DagRun{}
+	}
+	for i := range result.Data.Dags {
+		d := &result.Data.Dags[i]
+		if !contains(dagIds, d.DagId) {
+			continue
+		}
+		a.dags[d.DagId] = &d.Dag
+		if latest {
+			a.latestRuns[d.DagId] = d.LatestDagRun
+		}
+	}
+	return nil
+}
+
+// getDagRunById returns a single DAG run, bypassing the latest run logic.
+func getDagRunById(ctx context.Context, dagId string, dagRunId string, api *apiClient) (*DagRun, error) {
+	var result DagRun
+	if err := api.get(ctx, dagPath(dagId, "dagRuns", dagRunId), nil, &result); isStatus(err, http.StatusNotFound) {
+		return nil, errDagRunNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// confMatches reports whether the conf of a DAG run has all the expected
+// values.
+func confMatches(conf map[string]interface{}, expected map[string]string) bool {
+	for key, value := range expected {
+		actual, ok := conf[key]
+		if !ok || fmt.Sprint(actual) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// consecutiveFailures counts the failed runs among the latest runs of the DAG,
+// up to the failure threshold, stopping at the first run that did not fail.
+// The runs are those the latest run is selected from, with --skip-active-runs
+// paging through the active runs until the threshold is met.
+func consecutiveFailures(ctx context.Context, dagId string, api *apiClient) (int, error) {
+	limit := plugin.FailureThreshold
+	if len(api.runConfMatch) > 0 {
+		limit = api.historyLimit
+	}
+
+	failures := 0
+	err := api.eachDagRun(ctx, dagId, limit, func(dagRun *DagRun) bool {
+		if !isFailedState(dagId, dagRun.State) {
+			return false
+		}
+		failures++
+		return failures < plugin.FailureThreshold
+	})
+	return failures, err
+}
+
+// getLatestDagRunPerType returns the most recent DAG run of each run type,
+// looking at no more than the configured history limit of runs.
+func getLatestDagRunPerType(ctx context.Context, dagId string, api *apiClient) ([]DagRun, error) {
+	dagRuns, err := api.getDagRuns(ctx, dagId, api.historyLimit, 0, api.latestRunsFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	var result []DagRun
+	seen := map[string]bool{}
+	for _, r := range dagRuns.DagRuns {
+		if !seen[r.RunType] {
+			seen[r.RunType] = true
+			result = append(result, r)
+		}
+	}
+
+	return result, nil
+}
+
+func describeRunTypes(runs []DagRun) string {
+	states := make([]string, len(runs))
+	for i, r := range runs {
+		states[i] = r.RunType + "=" + r.State
+	}
+	return strings.Join(states, ", ")
+}
+
+func getLatestSuccessfulDagRun(ctx context.Context, dagId string, api *apiClient) (*DagRun, error) {
+	dagRuns, err := api.getDagRuns(ctx, dagId, 1, 0, url.Values{"order_by": {"-execution_date"}, "state": {"success"}})
+	if err != nil {
+		return nil, err
+	} else if len(dagRuns.DagRuns) == 0 {
+		return nil, nil
+	}
+	return &dagRuns.DagRuns[0], nil
+}
+
+var errWaitTimeout = errors.New("timed out waiting for DAG run")
+
+// waitForDagRun polls the latest DAG run until it reaches a terminal state or
+// the wait timeout expires, polling at least once. The wait ends by the
+// deadline of ctx, which bounds the whole check.
+func waitForDagRun(ctx context.Context, dagId string, api *apiClient) (*DagRun, error) {
+	deadline := time.Now().Add(time.Duration(plugin.WaitTimeout) * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	interval := time.Duration(plugin.PollInterval) * time.Second
+
+	for polls := 0; ; polls++ {
+		wait := interval
+		if left := time.Until(deadline); left < interval && polls > 0 {
+			return nil, errWaitTimeout
+		} else if left < interval {
+			// a single poll halfway to a deadline closer than the interval
+			wait = left / 2
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		dagRun, err := api.getLatestDagRun(ctx, dagId)
+		if err != nil {
+			return nil, err
+		} else if dagRun == nil || !isActiveState(dagRun.State) {
+			return dagRun, nil
+		}
+	}
+}
+
+// lastRan returns when the DAG run ended, or its logical date if it has not
+// ended yet.
+func lastRan(dagRun *DagRun) *time.Time {
+	if dagRun == nil {
+		return nil
+	} else if dagRun.EndDate != nil {
+		return dagRun.EndDate
+	}
+	return dagRun.ExecutionDate
+}
+
+// activeSince returns when the DAG run started, or when it was queued if it
+// has not started yet.
+func activeSince(dagRun *DagRun) *time.Time {
+	if dagRun.StartDate != nil {
+		return dagRun.StartDate
+	}
+	return dagRun.QueuedAt
+}
+
+// isFailedState reports whether a run state of the DAG is one of --fail-states,
+// unless --dag-ok-states makes it healthy for that DAG.
+func isFailedState(dagId string, state string) bool {
+	if states, ok := plugin.okStatesByDag[dagId]; ok && contains(states, state) {
+		return false
+	}
+	return contains(plugin.FailStates, state)
+}
+
+// okStates returns the healthy states of a completed run of the DAG, those of
+// --dag-ok-states when given for it and --ok-states otherwise.
+func okStates(dagId string) []string {
+	if states, ok := plugin.okStatesByDag[dagId]; ok {
+		return states
+	}
+	return plugin.OkStates
+}
+
+func parseDagStates(values []string) (map[string][]string, error) {
+	parsed := map[string][]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid --dag-ok-states %q, expected \"dag_id=state,state\"", v)
+		}
+		var states []string
+		for _, state := range strings.Split(parts[1], ",") {
+			if state = strings.TrimSpace(state); state != "" {
+				states = append(states, state)
+			}
+		}
+		parsed[strings.TrimSpace(parts[0])] = states
+	}
+	return parsed, nil
+}
+
+func isActiveState(state string) bool {
+	return state == "running" || state == "queued"
+}
+
+// getDagRuns returns a page of the runs of the DAG, of no more runs than the
+// history limit.
+func (a *apiClient) getDagRuns(ctx context.Context, dagId string, limit int, offset int, filter url.Values) (*DagRunList, error) {
+	if a.historyLimit > 0 && limit > a.historyLimit {
+		limit = a.historyLimit
+	}
+
+	query := url.Values{}
+	for k, v := range filter {
+		query[k] = v
+	}
+	query.Set("limit", fmt.Sprint(limit))
+	query.Set("offset", fmt.Sprint(offset))
+
+	var result DagRunList
+	if err := a.get(ctx, dagPath(dagId, "dagRuns"), query, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DagRunFilter is the request body of the batch DAG run list endpoint.
+type DagRunFilter struct {
+	DagIds       []string `json:"dag_ids,omitempty"`
+	States       []string `json:"states,omitempty"`
+	StartDateGte string   `json:"start_date_gte,omitempty"`
+	EndDateGte   string   `json:"end_date_gte,omitempty"`
+	PageLimit    int      `json:"page_limit,omitempty"`
+}
+
+func listDagRuns(ctx context.Context, filter DagRunFilter, api *apiClient) (*DagRunList, error) {
+	var result DagRunList
+	if err := api.send(ctx, "POST", "/dags/~/dagRuns/list", nil, filter, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type TaskInstance struct {
+	TaskId     string     `json:"task_id"`
+	State      string     `json:"state"`
+	TryNumber  int        `json:"try_number"`
+	QueuedWhen *time.Time `json:"queued_when"`
+}
+
+type TaskInstanceList struct {
+	TaskInstances []TaskInstance `json:"task_instances"`
+	TotalEntries  int            `json:"total_entries"`
+}
+
+func taskIds(tasks []TaskInstance) []string {
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.TaskId
+	}
+	return ids
+}
+
+type SlaMiss struct {
+	TaskId        string     `json:"task_id"`
+	ExecutionDate *time.Time `json:"execution_date"`
+}
+
+type SlaMissList struct {
+	SlaMisses    []SlaMiss `json:"sla_misses"`
+	TotalEntries int       `json:"total_entries"`
+}
+
+// missedSla returns the tasks that missed their SLA in the DAG run.
+func missedSla(misses []SlaMiss, dagRun *DagRun) []string {
+	var tasks []string
+	for _, m := range misses {
+		if m.ExecutionDate != nil && dagRun.ExecutionDate != nil && m.ExecutionDate.Equal(*dagRun.ExecutionDate) {
+			tasks = append(tasks, m.TaskId)
+		}
+	}
+	return tasks
+}
 
-func main() {
-	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
-	check.Execute()
+// completedTaskStates are the task instance states that will not change anymore.
+var completedTaskStates = []string{"success", "failed", "skipped", "upstream_failed", "removed"}
+
+func getTaskInstances(ctx context.Context, dagId string, dagRunId string, states []string, limit int, api *apiClient) (*TaskInstanceList, error) {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(limit))
+	for _, s := range states {
+		query.Add("state", s)
+	}
+
+	var result TaskInstanceList
+	if err := api.get(ctx, dagPath(dagId, "dagRuns", dagRunId, "taskInstances"), query, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
 }
 
-func checkArgs(event *corev2.Event) (int, error) {
-	_, err := url.Parse(plugin.AirflowApiUrl)
+// failureReason describes why a DAG run failed from its note and, when logs
+// are included, the tail of the log of a failed task instance. Errors while
+// retrieving the logs are ignored as the reason is informational only.
+func failureReason(ctx context.Context, dagId string, dagRun *DagRun, api *apiClient) string {
+	var reason string
+	if dagRun.Note != "" {
+		reason += fmt.Sprintf("\nNote: %s", dagRun.Note)
+	}
+
+	if !plugin.IncludeLogs {
+		return reason
+	}
+
+	failed, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, []string{"failed"}, 1, api)
+	if err != nil || len(failed.TaskInstances) == 0 {
+		return reason
+	}
+
+	task := failed.TaskInstances[0]
+	reason += fmt.Sprintf("\nFailed task: %s", task.TaskId)
+
+	log, err := getTaskLog(ctx, dagId, dagRun.DagRunId, task, api)
+	if err == nil && log != "" {
+		reason += "\n" + log
+	}
+
+	return reason
+}
+
+// getTaskLog returns the last log bytes of a task instance try, up to the
+// configured byte cap.
+func getTaskLog(ctx context.Context, dagId string, dagRunId string, task TaskInstance, api *apiClient) (string, error) {
+	// logs come as plain text, so only the request goes through the API client
+	resp, err := api.do(ctx, "GET", dagPath(dagId, "dagRuns", dagRunId, "taskInstances", task.TaskId, "logs", fmt.Sprint(task.TryNumber)), nil, nil, "text/plain")
 	if err != nil {
-		return sensu.CheckStateWarning, fmt.Errorf("failed to parse airflow URL %s: %v", plugin.AirflowApiUrl, err)
+		return "", err
 	}
 
-	if plugin.AirflowUsername == "" {
-		return sensu.CheckStateWarning, fmt.Errorf("airflow username is required")
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read task log response: %v", err)
 	}
 
-	if plugin.AirflowPassword == "" {
-		return sensu.CheckStateWarning, fmt.Errorf("airflow password is required")
+	log := strings.TrimSpace(string(body))
+	if len(log) > plugin.LogBytes {
+		log = strings.TrimSpace(log[len(log)-plugin.LogBytes:])
 	}
+	return log, nil
+}
 
-	return sensu.CheckStateOK, nil
+// checkProgress reports whether a running DAG run completed no task since
+// the previous check, and records the current progress in the state.
+func checkProgress(ctx context.Context, dagId string, dagRun *DagRun, api *apiClient) (bool, error) {
+	completed, err := getTaskInstances(ctx, dagId, dagRun.DagRunId, completedTaskStates, 1, api)
+	if err != nil {
+		return false, err
+	}
+
+	previous, found := state.Dags[dagId]
+	current := previous
+	current.DagRunId = dagRun.DagRunId
+	current.CompletedTasks = completed.TotalEntries
+	state.Dags[dagId] = current
+
+	return found && previous.DagRunId == dagRun.DagRunId && previous.CompletedTasks == completed.TotalEntries, nil
 }
 
-func executeCheck(event *corev2.Event) (int, error) {
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
+// State is persisted in the state file between check runs.
+type State struct {
+	Dags map[string]DagState `json:"dags"`
+}
 
-	var err error
-	explicit := true
-	dags := plugin.Dags
+type DagState struct {
+	DagRunId       string `json:"dag_run_id"`
+	CompletedTasks int    `json:"completed_tasks"`
+	// the run evaluated by the previous check, kept with --alert-new-failures
+	LastRunId string `json:"last_run_id,omitempty"`
+	LastState string `json:"last_state,omitempty"`
+}
 
-	if len(dags) == 0 {
-		explicit = false
-		var dagList *DagList
-		dagList, err = getAllDags(client)
-		if err != nil {
-			return sensu.CheckStateCritical, fmt.Errorf("could not retrieve DAGs: %v", err)
-		} else {
-			dags = make([]string, dagList.TotalEntries)
-			for i, d := range dagList.Dags {
-				dags[i] = d.DagId
-			}
-		}
+var state = State{Dags: map[string]DagState{}}
+
+// trackFailure records the run evaluated for a DAG, and downgrades a critical
+// failure to warning when the previous check already saw the same failed run.
+func trackFailure(health *Health) {
+	previous := state.Dags[health.DagId]
+	current := previous
+	current.LastRunId = health.DagRunId
+	current.LastState = health.RunState
+	state.Dags[health.DagId] = current
+
+	if health.Status == sensu.CheckStateCritical && isFailedState(health.DagId, health.RunState) &&
+		previous.LastRunId == health.DagRunId && isFailedState(health.DagId, previous.LastState) {
+		health.Status = sensu.CheckStateWarning
+		health.Error = fmt.Errorf("%w\nthe run already failed during the previous check", health.Error)
 	}
+}
 
-	health := checkDags(dags, explicit, client)
+// loadState reads the state file. A missing or corrupt state file results in
+// an empty state.
+func loadState() {
+	state = State{Dags: map[string]DagState{}}
 
-	oks := 0
-	warnings := 0
-	criticals := 0
-	unknowns := 0
-	found := false
+	body, err := os.ReadFile(plugin.StateFile)
+	if err != nil {
+		return
+	}
 
-	for _, h := range health {
-		found = true
-		switch h.Status {
-		case sensu.CheckStateOK:
-			oks++
-		case sensu.CheckStateWarning:
-			warnings++
-			fmt.Printf("%s WARNING\n", h.DagId)
-		case sensu.CheckStateCritical:
-			criticals++
-			fmt.Printf("%s CRITICAL\n", h.DagId)
-		default:
-			unknowns++
-			fmt.Printf("%s Unknown error code returned\n", h.DagId)
-		}
+	var loaded State
+	if err := json.Unmarshal(body, &loaded); err == nil && loaded.Dags != nil {
+		state = loaded
+	}
+}
 
-		if h.Error != nil {
-			fmt.Printf("Error occurred while checking DAG:\n%v\n", h.Error)
+func saveState() error {
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(plugin.StateFile, body, 0600)
+}
+
+// recordTrend appends the health percentage to the trend file and, when a
+// trend window is set, describes its evolution compared to the oldest entry
+// within the window.
+func recordTrend(now time.Time, percent int) (string, error) {
+	var trend string
+	if plugin.TrendWindow > 0 {
+		window := time.Duration(plugin.TrendWindow) * time.Second
+		if previous, ok := oldestTrendEntry(now.Add(-window)); ok {
+			trend = describeTrend(percent, previous, window)
 		}
 	}
 
-	if criticals > 0 || unknowns > 0 {
-		return sensu.CheckStateCritical, nil
-	} else if warnings > 0 {
-		return sensu.CheckStateWarning, nil
+	f, err := os.OpenFile(plugin.TrendFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return trend, err
 	}
+	defer f.Close()
 
-	if found {
-		fmt.Printf("All health checks returning OK for loaded DAGs")
-	} else {
-		fmt.Printf("No DAGs loaded")
+	_, err = fmt.Fprintf(f, "%s %d\n", now.UTC().Format(time.RFC3339), percent)
+	return trend, err
+}
+
+// oldestTrendEntry returns the health percentage of the oldest entry of the
+// trend file recorded at or after since. Unparsable lines are skipped.
+func oldestTrendEntry(since time.Time) (int, bool) {
+	body, err := os.ReadFile(plugin.TrendFile)
+	if err != nil {
+		return 0, false
 	}
 
-	return sensu.CheckStateOK, nil
+	for _, line := range strings.Split(string(body), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		recorded, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil || recorded.Before(since) {
+			continue
+		}
+		percent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		return percent, true
+	}
+	return 0, false
 }
 
-type Health struct {
-	DagId  string
-	Status int
-	Error  error
+func describeTrend(percent int, previous int, window time.Duration) string {
+	switch {
+	case percent > previous:
+		return fmt.Sprintf("Health %d%%, up %d%% over the last %s", percent, percent-previous, window)
+	case percent < previous:
+		return fmt.Sprintf("Health %d%%, down %d%% over the last %s", percent, previous-percent, window)
+	default:
+		return fmt.Sprintf("Health %d%%, unchanged over the last %s", percent, window)
+	}
 }
 
-func checkDags(dags []string, explicit bool, client *http.Client) []Health {
-	var result []Health
+// apiClient issues the requests of a check to one airflow API. It is built
+// once by checkDagHealth and passed down to every step of the check.
+type apiClient struct {
+	baseUrl string
+	creds   credentials
+	accept  string
+	headers http.Header
+	client  *http.Client
 
-	for _, dagId := range dags {
-		var health Health
-		health.DagId = dagId
-		health.Status = sensu.CheckStateOK
+	// the status codes of a successful response beside 2xx
+	okStatusCodes []int
 
-		var err error
-		var dag *Dag
-		dag, err = getDag(dagId, client)
+	// budget is the request budget enforced by the transport of client,
+	// consulted to tell the DAGs its exhaustion left unchecked
+	budget *requestBudget
 
-		if dag == nil {
-			health.Error = fmt.Errorf("could not retrieve DAG: %s\n%v", dagId, err)
-			health.Status = sensu.CheckStateCritical
-		} else if explicit && dag.IsPaused {
-			health.Error = fmt.Errorf("DAG is paused and will not process: %s", dagId)
-			health.Status = sensu.CheckStateWarning
-		} else {
-			var dagRun *DagRun
-			dagRun, err = getLatestDagRun(dagId, client)
+	// the selection of the latest DAG run
+	historyLimit   int
+	runConfMatch   map[string]string
+	skipActiveRuns bool
+	since          time.Duration
 
-			if err != nil {
-				health.Error = err
-				health.Status = sensu.CheckStateCritical
-			} else if dagRun != nil && dagRun.State == "failed" {
-				health.Error = fmt.Errorf("DAG failed its last execution: %s", dagId)
-				health.Status = sensu.CheckStateCritical
-			}
-		}
+	// dags memoizes the DAGs retrieved during the check, nil to retrieve
+	// them on every call
+	dags map[string]*Dag
 
-		result = append(result, health)
+	// latestRuns holds the latest DAG runs returned by the GraphQL query,
+	// each used once
+	latestRuns map[string]*DagRun
+}
+
+// newAPIClient returns the apiClient of the airflow API configured by cfg,
+// sending the headers of --header on every request through client.
+func newAPIClient(cfg Config, client *http.Client) *apiClient {
+	return &apiClient{
+		baseUrl:        airflowApiUrl(cfg),
+		creds:          newCredentials(cfg),
+		accept:         cfg.AcceptHeader,
+		headers:        cfg.customHeaders,
+		client:         client,
+		okStatusCodes:  cfg.OkStatusCodes,
+		historyLimit:   cfg.HistoryLimit,
+		runConfMatch:   cfg.RunConfMatch,
+		skipActiveRuns: cfg.SkipActiveRuns,
+		since:          time.Duration(cfg.Since) * time.Second,
 	}
+}
 
-	return result
+// requestBudget bounds the API requests of a check to --max-total-requests.
+// Under --urls a single budget covers all the instances. A nil budget or a
+// zero maximum is unlimited.
+type requestBudget struct {
+	max     int64
+	used    int64
+	refused int64
 }
 
-type Dag struct {
-	DagId    string `json:"dag_id"`
-	IsPaused bool   `json:"is_paused"`
+func newRequestBudget(max int) *requestBudget {
+	return &requestBudget{max: int64(max)}
 }
 
-func getDag(dagId string, client *http.Client) (*Dag, error) {
-	req, err := http.NewRequest("GET", getAirflowApiUrl()+"/dags/"+dagId, nil)
-	if err != nil {
-		return nil, err
+// take accounts for a request, reporting false once the budget is spent.
+func (b *requestBudget) take() bool {
+	if b == nil || b.max == 0 {
+		return true
 	}
+	if atomic.AddInt64(&b.used, 1) > b.max {
+		atomic.AddInt64(&b.refused, 1)
+		return false
+	}
+	return true
+}
 
-	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(plugin.AirflowUsername, plugin.AirflowPassword)
+// left reports whether the budget allows another request.
+func (b *requestBudget) left() bool {
+	return b == nil || b.max == 0 || atomic.LoadInt64(&b.used) < b.max
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
+// refusals returns the number of requests refused so far.
+func (b *requestBudget) refusals() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.refused)
+}
+
+// newAirflowClient returns the HTTP client of the airflow API configured by
+// cfg, with its retries, timeout and redirect policy. Its transport counts the
+// requests for the success rate of the check, and charges every attempt to
+// the budget.
+func newAirflowClient(cfg Config, budget *requestBudget) (*http.Client, error) {
+	if err := validateUrl(cfg.AirflowApiUrl); err != nil {
 		return nil, err
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("get DAG request returned an invalid status code: %s", resp.Status)
 	}
 
-	defer resp.Body.Close()
+	var base http.RoundTripper = newTransport(cfg)
+	if cfg.Debug {
+		base = &debugTransport{transport: base}
+	}
+	transport := &countingTransport{transport: &retryTransport{
+		transport: &budgetTransport{transport: base, budget: budget},
+		retries:   cfg.Retries,
+		delay:     time.Duration(cfg.RetryDelay) * time.Millisecond,
+	}}
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       time.Duration(cfg.Timeout) * time.Second,
+		CheckRedirect: redirectPolicy(cfg.FollowRedirects, newCredentials(cfg)),
+	}, nil
+}
 
-	var result Dag
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode DAG response: %v", err)
+// isOkStatus reports whether the status code is one of --ok-status-codes.
+func (a *apiClient) isOkStatus(code int) bool {
+	for _, c := range a.okStatusCodes {
+		if c == code {
+			return true
+		}
 	}
+	return false
+}
 
-	return &result, nil
+// dagPath returns the API path of the DAG followed by the elements, each of
+// them escaped so that a DAG, run or task ID cannot alter the path.
+func dagPath(dagId string, elems ...string) string {
+	p := "/dags/" + url.PathEscape(dagId)
+	for _, e := range elems {
+		p += "/" + url.PathEscape(e)
+	}
+	return p
 }
 
-type DagList struct {
-	Dags         []Dag `json:"dags"`
-	TotalEntries int   `json:"total_entries"`
+// get issues a GET request to the path of the airflow API and decodes the JSON
+// response into out.
+func (a *apiClient) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return a.send(ctx, "GET", path, query, nil, out)
 }
 
-func getAllDags(client *http.Client) (*DagList, error) {
-	req, err := http.NewRequest("GET", getAirflowApiUrl()+"/dags", nil)
+// do issues a request to the path of the airflow API, with body encoded as
+// JSON unless nil, accepting the media type. A response with a status outside
+// 2xx and --ok-status-codes results in an apiError, otherwise the caller closes
+// its body.
+func (a *apiClient) do(ctx context.Context, method string, path string, query url.Values, body interface{}, accept string) (*http.Response, error) {
+	endpoint := a.baseUrl + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(plugin.AirflowUsername, plugin.AirflowPassword)
+	req.Header.Set("Accept", accept)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	a.creds.authorize(req)
+	for name, values := range a.headers {
+		req.Header[name] = values
+	}
 
-	resp, err := client.Do(req)
+	resp, err := a.client.Do(req)
 	if err != nil {
 		return nil, err
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("get all DAGs request returned an invalid status code: %s", resp.Status)
+	} else if (resp.StatusCode < 200 || resp.StatusCode > 299) && !a.isOkStatus(resp.StatusCode) {
+		return nil, newAPIError(method+" "+path, resp)
+	}
+	return resp, nil
+}
+
+// send issues a request to the path of the airflow API, with body encoded as
+// JSON unless nil, and decodes the JSON response into out.
+func (a *apiClient) send(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := a.do(ctx, method, path, query, body, a.accept)
+	if err != nil {
+		return err
 	}
 
 	defer resp.Body.Close()
 
-	var result DagList
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode DAG list response: %v", err)
+	// an empty body would decode into a zero value without error, and a proxy
+	// error page would only fail with an obscure decode error
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s %s response: %v", method, path, err)
+	} else if len(bytes.TrimSpace(data)) == 0 {
+		// a 200 always carries the JSON document, only the other codes
+		// allowed by --ok-status-codes may come without a body
+		if resp.StatusCode != http.StatusOK && a.isOkStatus(resp.StatusCode) {
+			return nil
+		}
+		return fmt.Errorf("%s %s returned an empty response: %s", method, path, resp.Status)
 	}
 
-	return &result, nil
+	if err := json.Unmarshal(data, out); err != nil {
+		snippet := data
+		if len(snippet) > apiErrorBodyLimit {
+			snippet = snippet[:apiErrorBodyLimit]
+		}
+		return fmt.Errorf("%s %s returned a response that is not JSON: %s, Content-Type %q: %s",
+			method, path, resp.Status, resp.Header.Get("Content-Type"), strings.TrimSpace(string(snippet)))
+	}
+	return nil
 }
 
-type DagRun struct {
-	State string `json:"state"`
+// apiError is returned when the airflow API answers with an unexpected status code.
+type apiError struct {
+	Request    string
+	StatusCode int
+	Status     string
+	Body       string
 }
 
-type DagRunList struct {
-	DagRuns      []DagRun `json:"dag_runs"`
-	TotalEntries int      `json:"total_entries"`
+// apiErrorBodyLimit is the number of bytes of the response body kept in an
+// apiError to describe the problem.
+const apiErrorBodyLimit = 256
+
+// newAPIError builds an apiError from the response, keeping the start of its
+// body, and closes the body.
+func newAPIError(request string, resp *http.Response) *apiError {
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+	return &apiError{
+		Request:    request,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+func (e *apiError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s request returned an invalid status code: %s", e.Request, e.Status)
+	}
+	return fmt.Sprintf("%s request returned an invalid status code: %s: %s", e.Request, e.Status, e.Body)
+}
+
+var (
+	errAuthFailed  = errors.New("authentication failed against Airflow API")
+	errMaintenance = errors.New("airflow is in maintenance")
+	errDagNotFound = errors.New("DAG not found")
+
+	errDagRunNotFound = errors.New("DAG run not found")
+	errRequestBudget  = errors.New("request budget exceeded")
+)
+
+func isStatus(err error, code int) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == code
+}
+
+func isAuthFailure(err error) bool {
+	return isStatus(err, http.StatusUnauthorized)
+}
+
+// isUnreachable reports whether a request failed to connect to the airflow
+// API or timed out, unlike an error status or a rejected redirect.
+func isUnreachable(err error) bool {
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// isMaintenance reports whether the error stems from airflow being in
+// maintenance, which is only considered when maintenance awareness is enabled.
+func isMaintenance(err error) bool {
+	return plugin.MaintenanceAware && isStatus(err, http.StatusServiceUnavailable) && inMaintenanceWindow(time.Now())
 }
 
-func getLatestDagRun(dagId string, client *http.Client) (*DagRun, error) {
-	dagRuns, err := getDagRuns(dagId, 1, 0, client)
+// inMaintenanceWindow reports whether t is within the configured daily
+// maintenance window. Without a window, any time is.
+func inMaintenanceWindow(t time.Time) bool {
+	if plugin.MaintenanceWindow == "" {
+		return true
+	}
+
+	start, end, err := parseMaintenanceWindow(plugin.MaintenanceWindow)
 	if err != nil {
-		return nil, err
-	} else if dagRuns.TotalEntries == 0 {
-		return nil, nil
+		return false
+	}
+
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	// the window spans midnight
+	return minute >= start || minute < end
+}
+
+// parseMaintenanceWindow parses a window formatted as HH:MM-HH:MM into its
+// start and end in minutes since midnight.
+func parseMaintenanceWindow(window string) (int, int, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("maintenance window must be formatted as HH:MM-HH:MM: %s", window)
+	}
+
+	var minutes [2]int
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("maintenance window must be formatted as HH:MM-HH:MM: %s", window)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
 	}
 
-	dagRuns, err = getDagRuns(dagId, 1, dagRuns.TotalEntries-1, client)
+	return minutes[0], minutes[1], nil
+}
 
+// readPasswordFile reads the password from the file, ignoring the surrounding
+// whitespace such as a trailing newline.
+func readPasswordFile(path string) (string, error) {
+	password, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
-	} else if len(dagRuns.DagRuns) == 0 {
-		return nil, nil
+		return "", fmt.Errorf("failed to read password file %s: %v", path, err)
+	}
+	return strings.TrimSpace(string(password)), nil
+}
+
+// credentials authenticate the requests of the airflow API.
+type credentials struct {
+	username string
+	password string
+	token    string
+	noAuth   bool
+}
+
+func newCredentials(cfg Config) credentials {
+	return credentials{
+		username: cfg.AirflowUsername,
+		password: cfg.AirflowPassword,
+		token:    cfg.Token,
+		noAuth:   cfg.NoAuth,
+	}
+}
+
+// authorize authenticates the request with the bearer token when set, and
+// with basic auth otherwise. With --no-auth the request carries no
+// credentials.
+func (c credentials) authorize(req *http.Request) {
+	if c.noAuth {
+		return
+	} else if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
 	} else {
-		return &dagRuns.DagRuns[0], nil
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// redirectPolicy rejects the redirects of the airflow API unless follow is set
+// with --follow-redirects, so the credentials do not leak to an unexpected
+// host. Followed redirects only carry the credentials to the original host,
+// and only when the original request carried them.
+func redirectPolicy(follow bool, creds credentials) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !follow {
+			return fmt.Errorf("airflow API redirected to %s, use --follow-redirects to follow it", req.URL.Redacted())
+		} else if len(via) >= 10 {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+
+		if req.URL.Host == via[0].URL.Host && via[0].Header.Get("Authorization") != "" {
+			creds.authorize(req)
+		} else {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+}
+
+func parseHeaders(headers []string) (http.Header, error) {
+	parsed := http.Header{}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: Value\"", h)
+		}
+		parsed.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return parsed, nil
+}
+
+// newTransport returns a transport configured from the TLS, proxy and
+// connection options of cfg, leaving http.DefaultTransport untouched. Without
+// --proxy, the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables. The certificates are those loaded by checkArgs.
+func newTransport(cfg Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy, err := url.Parse(cfg.Proxy); err == nil && cfg.Proxy != "" {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if cfg.MaxIdleConns > 0 {
+		// the checks only talk to the airflow API, so all idle connections
+		// may go to its host
+		transport.MaxIdleConns = cfg.MaxIdleConns
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	}
+	transport.DisableKeepAlives = cfg.DisableKeepAlives
+	if cfg.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, Certificates: cfg.clientCerts}
+	} else if cfg.rootCAs != nil || cfg.clientCerts != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: cfg.rootCAs, Certificates: cfg.clientCerts}
 	}
+	return transport
 }
 
-func getDagRuns(dagId string, limit int, offset int, client *http.Client) (*DagRunList, error) {
-	req, err := http.NewRequest("GET", getAirflowApiUrl()+"/dags/"+dagId+"/dagRuns?limit="+fmt.Sprint(limit)+"&offset="+fmt.Sprint(offset), nil)
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read CA certificate %s: %v", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// stderr receives the diagnostics of --debug and --timings, kept apart from
+// the check output.
+var stderr io.Writer = os.Stderr
+
+func debugf(format string, args ...interface{}) {
+	if plugin.Debug {
+		fmt.Fprintf(stderr, "debug: "+format+"\n", args...)
+	}
+}
+
+func describeRunState(state string) string {
+	if state == "" {
+		return "none"
 	}
+	return state
+}
 
-	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(plugin.AirflowUsername, plugin.AirflowPassword)
+// debugTransport logs each request and the status of its response.
+type debugTransport struct {
+	transport http.RoundTripper
+}
 
-	resp, err := client.Do(req)
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
 	if err != nil {
-		return nil, err
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("get latest DAG run request returned an invalid status code: %s", resp.Status)
+		debugf("%s %s -> %v", req.Method, req.URL, err)
+	} else {
+		debugf("%s %s -> %s", req.Method, req.URL, resp.Status)
 	}
+	return resp, err
+}
 
-	defer resp.Body.Close()
+// budgetTransport refuses the requests exceeding the budget of the check. It
+// sits below retryTransport so that retries are charged as well.
+type budgetTransport struct {
+	transport http.RoundTripper
+	budget    *requestBudget
+}
 
-	var result DagRunList
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode DAG run list response: %v", err)
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.budget.take() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errRequestBudget
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// countingTransport records the outcome of every request sent to the airflow
+// API. Only transport errors, 5xx and 429 responses count as failures, a 4xx
+// response like a missing DAG being an answer of a healthy API. A request
+// ending refused by the budget is left out, as its outcome says nothing of
+// airflow.
+type countingTransport struct {
+	transport http.RoundTripper
+	calls     int
+	failures  int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if errors.Is(err, errRequestBudget) {
+		return resp, err
 	}
+	t.calls++
+	if err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		t.failures++
+	}
+	return resp, err
+}
 
-	return &result, nil
+func (t *countingTransport) successRate() int {
+	if t.calls == 0 {
+		return 100
+	}
+	return (t.calls - t.failures) * 100 / t.calls
 }
 
-func getAirflowApiUrl() string {
-	// a trailing slash will cause errors
-	return strings.TrimSuffix(plugin.AirflowApiUrl, "/") + "/api/v1"
+// retryTransport retries requests failing with a network error or a 5xx
+// status code, doubling the delay between attempts. A 429 response is retried
+// once after the delay its Retry-After header asks for. It gives up early once
+// the request context is done.
+type retryTransport struct {
+	transport http.RoundTripper
+	retries   int
+	delay     time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.delay
+	throttled := false
+
+	for attempt := 0; ; {
+		resp, err := t.transport.RoundTrip(req)
+
+		var wait time.Duration
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests && !throttled {
+			throttled = true
+			wait = retryAfter(resp, time.Now())
+		} else if attempt < t.retries && !errors.Is(err, errRequestBudget) && (err != nil || resp.StatusCode >= 500) {
+			attempt++
+			wait = delay
+			delay *= 2
+		} else {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		if req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter returns the delay asked for by the Retry-After header of the
+// response, given either in seconds or as a date.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// airflowApiUrl returns the base URL of the versioned REST API of cfg.
+func airflowApiUrl(cfg Config) string {
+	api := "api/" + cfg.ApiVersion
+
+	base, err := url.Parse(cfg.AirflowApiUrl)
+	if err != nil {
+		return strings.TrimRight(cfg.AirflowApiUrl, "/") + "/" + api
+	}
+
+	apiPath := path.Join("/", base.Path, cfg.InstancePrefix)
+	if !strings.HasSuffix(apiPath, "/"+api) {
+		apiPath = path.Join(apiPath, api)
+	}
+
+	base.Path = apiPath
+	base.RawPath = ""
+	return base.String()
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -1,8 +1,4599 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/spf13/cobra"
 )
 
 func TestMain(t *testing.T) {
 }
+
+// useServer points the plugin at a test server running handler and restores
+// the plugin configuration once the test completes.
+func useServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	saved := plugin
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		server.Close()
+		plugin = saved
+	})
+
+	plugin.AirflowApiUrl = server.URL
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	plugin.Timeout = 5
+	plugin.AllUnknownState = "critical"
+	plugin.AuthFailureState = "critical"
+	plugin.MaintenanceState = "ok"
+	plugin.UntrackedState = "warning"
+	plugin.UndeployedState = "critical"
+	plugin.FailureThreshold = 1
+	plugin.HistoryLimit = 25
+	plugin.NoDagsStatus = "warning"
+	plugin.NotFoundState = "warning"
+	plugin.PausedState = "warning"
+	plugin.OkStates = []string{"success"}
+	plugin.FailStates = []string{"failed"}
+
+	return server
+}
+
+// routes answers requests for the given paths with a JSON body and all other
+// requests with 404.
+func routes(routes map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	})
+}
+
+func TestNewCheckResult(t *testing.T) {
+	summary := &Summary{Oks: 2, Warnings: 1}
+	result, err := newCheckResult(sensu.CheckStateWarning, "my_dag WARNING\n", summary)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("failed to marshal check result: %v", err)
+	}
+
+	var event corev2.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("failed to unmarshal check result: %v", err)
+	}
+
+	if err := event.Check.Validate(); err != nil {
+		t.Errorf("check result is not a valid check: %v", err)
+	}
+	if event.Check.Name != "airflow-dag-check" {
+		t.Errorf("expected check name airflow-dag-check, got %s", event.Check.Name)
+	}
+	if event.Check.Status != sensu.CheckStateWarning {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateWarning, event.Check.Status)
+	}
+	if event.Check.Output != "my_dag WARNING\n" {
+		t.Errorf("unexpected output: %q", event.Check.Output)
+	}
+	if len(event.Metrics.Points) != 5 {
+		t.Fatalf("expected 5 metric points, got %d", len(event.Metrics.Points))
+	}
+	if p := event.Metrics.Points[0]; p.Name != "airflow_dag_check.oks" || p.Value != 2 {
+		t.Errorf("unexpected metric point: %s=%v", p.Name, p.Value)
+	}
+}
+
+func TestRedactHealth(t *testing.T) {
+	health := []Health{
+		{DagId: "customer_acme", Status: sensu.CheckStateCritical, Error: fmt.Errorf("DAG failed its last execution: customer_acme")},
+		{DagId: "customer_other", Status: sensu.CheckStateOK},
+	}
+
+	if err := redactHealth(health); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	redacted := redactDagId("customer_acme")
+	if redacted != redactDagId("customer_acme") {
+		t.Errorf("expected redacted DAG ID to be stable")
+	}
+	if health[0].DagId != redacted {
+		t.Errorf("expected DAG ID %s, got %s", redacted, health[0].DagId)
+	}
+	if strings.Contains(health[0].Error.Error(), "customer_acme") {
+		t.Errorf("expected DAG ID to be redacted from error: %v", health[0].Error)
+	}
+	if health[1].DagId == "customer_other" || health[1].DagId == redacted {
+		t.Errorf("expected distinct redacted DAG ID, got %s", health[1].DagId)
+	}
+}
+
+func TestCheckFailedInWindow(t *testing.T) {
+	var filter DagRunFilter
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/api/v1/dags" {
+			fmt.Fprint(w, `{"dags": [], "total_entries": 0}`)
+			return
+		}
+		if r.Method != "POST" || r.URL.Path != "/api/v1/dags/~/dagRuns/list" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+			t.Errorf("failed to decode filter: %v", err)
+		}
+		fmt.Fprint(w, `{"dag_runs": [{"dag_id": "etl", "dag_run_id": "scheduled__1", "state": "failed"}], "total_entries": 1}`)
+	}))
+	plugin.AnyFailedWithin = 3600
+
+	var output bytes.Buffer
+	status, _, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected critical, got %d", status)
+	}
+	if len(filter.States) != 1 || filter.States[0] != "failed" || filter.EndDateGte == "" {
+		t.Errorf("unexpected filter: %+v", filter)
+	}
+	if !strings.Contains(output.String(), "etl scheduled__1 FAILED") {
+		t.Errorf("expected failed run in output, got %q", output.String())
+	}
+}
+
+func TestCheckDagLatestPerRunType(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl", "is_paused": false}`)
+		case "/api/v1/dags/etl/dagRuns":
+			if r.URL.Query().Get("order_by") != "-execution_date" {
+				t.Errorf("expected runs ordered newest first, got %s", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, `{"dag_runs": [
+				{"dag_run_id": "manual__2", "run_type": "manual", "state": "success"},
+				{"dag_run_id": "scheduled__1", "run_type": "scheduled", "state": "failed"},
+				{"dag_run_id": "manual__0", "run_type": "manual", "state": "failed"}
+			], "total_entries": 3}`)
+		default:
+			t.Errorf("unexpected request: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.LatestPerType = true
+	plugin.HistoryLimit = 25
+
+	health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical {
+		t.Fatalf("expected critical, got %d", health.Status)
+	}
+	if msg := health.Error.Error(); !strings.Contains(msg, "last scheduled execution") || !strings.Contains(msg, "manual=success, scheduled=failed") {
+		t.Errorf("unexpected error message: %s", msg)
+	}
+}
+
+func TestCheckProgress(t *testing.T) {
+	completed := 2
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/dags/etl/dagRuns/run_1/taskInstances" {
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+		fmt.Fprintf(w, `{"task_instances": [], "total_entries": %d}`, completed)
+	}))
+	plugin.StateFile = filepath.Join(t.TempDir(), "state.json")
+	loadState()
+
+	dagRun := &DagRun{DagRunId: "run_1", State: "running"}
+	steps := []struct {
+		completed int
+		stalled   bool
+	}{
+		{2, false},
+		{3, false},
+		{3, true},
+	}
+
+	for i, step := range steps {
+		completed = step.completed
+		stalled, err := checkProgress(context.Background(), "etl", dagRun, testAPI(http.DefaultClient))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stalled != step.stalled {
+			t.Errorf("step %d: expected stalled=%v, got %v", i, step.stalled, stalled)
+		}
+		if err := saveState(); err != nil {
+			t.Fatalf("failed to save state: %v", err)
+		}
+		loadState()
+	}
+}
+
+func TestGetAirflowApiUrl(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	tests := []struct {
+		url      string
+		prefix   string
+		expected string
+	}{
+		{"http://localhost:8080", "", "http://localhost:8080/api/v1"},
+		{"http://localhost:8080/", "", "http://localhost:8080/api/v1"},
+		{"http://localhost:8080//", "", "http://localhost:8080/api/v1"},
+		{"http://localhost:8080/team-a/airflow/", "", "http://localhost:8080/team-a/airflow/api/v1"},
+		{"http://localhost:8080", "team-a/airflow", "http://localhost:8080/team-a/airflow/api/v1"},
+		{"http://localhost:8080/", "/team-a/airflow/", "http://localhost:8080/team-a/airflow/api/v1"},
+		{"http://localhost:8080/platform", "team-b", "http://localhost:8080/platform/team-b/api/v1"},
+		{"http://localhost:8080", "/", "http://localhost:8080/api/v1"},
+		{"https://host/airflow", "", "https://host/airflow/api/v1"},
+		{"https://host/airflow/api/v1", "", "https://host/airflow/api/v1"},
+		{"https://host/airflow/api/v1/", "", "https://host/airflow/api/v1"},
+		{"https://host/api/v1", "", "https://host/api/v1"},
+	}
+
+	plugin.ApiVersion = "v1"
+	for _, tt := range tests {
+		plugin.AirflowApiUrl = tt.url
+		plugin.InstancePrefix = tt.prefix
+		if actual := airflowApiUrl(plugin); actual != tt.expected {
+			t.Errorf("url %q prefix %q: expected %s, got %s", tt.url, tt.prefix, tt.expected, actual)
+		}
+	}
+
+	plugin.ApiVersion = "v2"
+	plugin.AirflowApiUrl = "https://host/airflow/"
+	plugin.InstancePrefix = ""
+	if actual := airflowApiUrl(plugin); actual != "https://host/airflow/api/v2" {
+		t.Errorf("expected the configured API version, got %s", actual)
+	}
+}
+
+func TestIntervalLag(t *testing.T) {
+	var dagRun DagRun
+	body := `{"dag_run_id": "scheduled__1", "state": "success", "data_interval_end": "2021-05-10T02:00:00+00:00", "end_date": "2021-05-10T05:30:00+00:00"}`
+	if err := json.Unmarshal([]byte(body), &dagRun); err != nil {
+		t.Fatalf("failed to decode DAG run: %v", err)
+	}
+
+	if lag := intervalLag(&dagRun); lag != 3*time.Hour+30*time.Minute {
+		t.Errorf("expected lag of 3h30m, got %s", lag)
+	}
+
+	dagRun.EndDate = nil
+	if lag := intervalLag(&dagRun); lag != 0 {
+		t.Errorf("expected no lag for an unfinished run, got %s", lag)
+	}
+	if lag := intervalLag(nil); lag != 0 {
+		t.Errorf("expected no lag without a run, got %s", lag)
+	}
+}
+
+// openMetricsLine matches the metric family and sample lines produced by
+// formatOpenMetrics.
+var openMetricsLine = regexp.MustCompile(`^(# (TYPE|HELP) [a-z_]+ .+|[a-z_]+(\{[a-z_]+="(\\.|[^"\\])*"(,[a-z_]+="(\\.|[^"\\])*")*\})? \d+)$`)
+
+func TestFormatOpenMetrics(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+	plugin.FailStates = []string{"failed"}
+	plugin.Heartbeat = true
+
+	summary := &Summary{
+		Dags: []Health{
+			{DagId: "ok_dag", DagRunId: "scheduled__1", RunState: "success", Status: sensu.CheckStateOK},
+			{DagId: "failed_dag", DagRunId: "manual__\"2\"", RunState: "failed", Status: sensu.CheckStateCritical},
+		},
+		Findings: []Finding{
+			{Dimension: "health", Status: sensu.CheckStateOK},
+			{Dimension: "connections", Status: sensu.CheckStateOK},
+			{Dimension: "connections", Status: sensu.CheckStateCritical, Message: "connection test failed: warehouse"},
+		},
+	}
+
+	output := formatOpenMetrics(summary)
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+
+	if lines[len(lines)-1] != "# EOF" {
+		t.Fatalf("expected output to end with # EOF, got %q", lines[len(lines)-1])
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if !openMetricsLine.MatchString(line) {
+			t.Errorf("invalid OpenMetrics line: %q", line)
+		}
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(output))
+	if err != nil {
+		t.Fatalf("invalid metrics: %v\n%s", err, output)
+	}
+	for name, family := range families {
+		if family.GetType() != dto.MetricType_GAUGE {
+			t.Errorf("expected %s to be a gauge, got %s", name, family.GetType())
+		}
+	}
+
+	expected := map[string]float64{
+		`airflow_dag_up{dag_id="ok_dag"}`:                                      1,
+		`airflow_dag_up{dag_id="failed_dag"}`:                                  0,
+		`airflow_dag_run_failed{dag_id="ok_dag",dag_run_id="scheduled__1"}`:    0,
+		`airflow_dag_run_failed{dag_id="failed_dag",dag_run_id="manual__"2""}`: 1,
+		`airflow_check_state{dimension="health"}`:                              0,
+		`airflow_check_state{dimension="connections"}`:                         2,
+	}
+	samples := map[string]float64{}
+	for name, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, l.GetName(), l.GetValue()))
+			}
+			key := name
+			if len(labels) > 0 {
+				key += "{" + strings.Join(labels, ",") + "}"
+			}
+			samples[key] = m.GetGauge().GetValue()
+		}
+	}
+	for key, value := range expected {
+		if actual, ok := samples[key]; !ok || actual != value {
+			t.Errorf("expected %s %v, got %v in:\n%s", key, value, actual, output)
+		}
+	}
+
+	heartbeat := families["airflow_check_heartbeat_timestamp_seconds"]
+	if heartbeat == nil || len(heartbeat.GetMetric()) != 1 || time.Since(time.Unix(int64(heartbeat.GetMetric()[0].GetGauge().GetValue()), 0)) > time.Minute {
+		t.Errorf("expected the heartbeat timestamp in:\n%s", output)
+	}
+}
+
+func TestCheckDagHealthPool(t *testing.T) {
+	checked := map[string]bool{}
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl"}, {"dag_id": "report"}], "total_entries": 2}`)
+		case "/api/v1/pools/warehouse":
+			fmt.Fprint(w, `{"name": "warehouse", "slots": 4, "occupied_slots": 1, "open_slots": 3}`)
+		case "/api/v1/dags/etl/tasks":
+			fmt.Fprint(w, `{"tasks": [{"task_id": "extract", "pool": "default_pool"}, {"task_id": "load", "pool": "warehouse"}], "total_entries": 2}`)
+		case "/api/v1/dags/report/tasks":
+			fmt.Fprint(w, `{"tasks": [{"task_id": "render", "pool": "default_pool"}], "total_entries": 1}`)
+		case "/api/v1/dags/etl", "/api/v1/dags/report":
+			checked[strings.TrimPrefix(r.URL.Path, "/api/v1/dags/")] = true
+			fmt.Fprint(w, `{"dag_id": "x"}`)
+		default:
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		}
+	}))
+	plugin.Pool = "warehouse"
+
+	status, _, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status != sensu.CheckStateOK {
+		t.Errorf("expected ok, got %d", status)
+	}
+	if !checked["etl"] || checked["report"] {
+		t.Errorf("expected only etl to be checked, got %v", checked)
+	}
+}
+
+func TestCheckDagHealthMissingPool(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/dags" {
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	plugin.Pool = "missing"
+
+	var output bytes.Buffer
+	status, _, _ := checkDagHealth(&output)
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected warning, got %d", status)
+	}
+	if !strings.Contains(output.String(), "Pool does not exist: missing") {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestCheckRunRate(t *testing.T) {
+	total := 0
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"dag_runs": [], "total_entries": %d}`, total)
+	}))
+	plugin.MinRunsPerMinute = 1
+	plugin.RunRateWindow = 600
+
+	tests := []struct {
+		total    int
+		expected int
+	}{
+		{12, sensu.CheckStateOK},
+		{10, sensu.CheckStateOK},
+		{3, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		total = tt.total
+		if finding := checkRunRate(context.Background(), testAPI(http.DefaultClient)); finding.Status != tt.expected {
+			t.Errorf("%d runs: expected state %d, got %d (%s)", tt.total, tt.expected, finding.Status, finding.Message)
+		}
+	}
+}
+
+func TestCheckRunOrder(t *testing.T) {
+	latest := map[string]string{}
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != "success" {
+			t.Errorf("expected successful runs to be requested, got %s", r.URL.RawQuery)
+		}
+		dagId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/dags/"), "/dagRuns")
+		if date, ok := latest[dagId]; ok {
+			fmt.Fprintf(w, `{"dag_runs": [{"dag_id": "%s", "state": "success", "execution_date": "%s"}], "total_entries": 1}`, dagId, date)
+		} else {
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		}
+	}))
+
+	latest["extract"] = "2021-05-10T00:00:00+00:00"
+	latest["load"] = "2021-05-10T01:00:00+00:00"
+	if finding := checkRunOrder(context.Background(), []string{"extract", "load"}, testAPI(http.DefaultClient)); finding.Status != sensu.CheckStateOK {
+		t.Errorf("expected ok, got %d (%s)", finding.Status, finding.Message)
+	}
+
+	latest["load"] = "2021-05-09T01:00:00+00:00"
+	if finding := checkRunOrder(context.Background(), []string{"extract", "load"}, testAPI(http.DefaultClient)); finding.Status != sensu.CheckStateWarning {
+		t.Errorf("expected warning for out of order runs, got %d", finding.Status)
+	}
+
+	delete(latest, "load")
+	if finding := checkRunOrder(context.Background(), []string{"extract", "load"}, testAPI(http.DefaultClient)); finding.Status != sensu.CheckStateWarning {
+		t.Errorf("expected warning for missing downstream run, got %d", finding.Status)
+	}
+}
+
+func TestCheckDagHealthAuthFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		state    string
+		expected int
+	}{
+		{"unauthorized", http.StatusUnauthorized, "critical", sensu.CheckStateCritical},
+		{"forbidden", http.StatusForbidden, "critical", sensu.CheckStateCritical},
+		{"configured state", http.StatusUnauthorized, "unknown", sensu.CheckStateUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(tt.code)
+			}))
+			plugin.Dags = []string{"etl", "report", "cleanup"}
+			plugin.AuthFailureState = tt.state
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, status)
+			}
+			if requests != 1 {
+				t.Errorf("expected the DAG checks to be skipped, got %d requests", requests)
+			}
+			if output.String() != "Authentication to Airflow failed, check credentials\n" {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthUnreachable(t *testing.T) {
+	server := useServer(t, http.NotFoundHandler())
+	server.Close()
+	plugin.Dags = []string{"etl", "report", "cleanup"}
+
+	var output bytes.Buffer
+	status, _, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected critical, got %d", status)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "Airflow API unreachable at "+server.URL+": ") {
+		t.Errorf("expected a single unreachable message, got %q", output.String())
+	}
+}
+
+func TestCheckDagExpectTaskCount(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/etl":                             `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":                     `{"dag_runs": [{"dag_run_id": "run_1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/etl/dagRuns/run_1/taskInstances": `{"task_instances": [], "total_entries": 7}`,
+	}))
+
+	tests := []struct {
+		expected  int
+		tolerance int
+		status    int
+	}{
+		{7, 0, sensu.CheckStateOK},
+		{10, 0, sensu.CheckStateWarning},
+		{10, 3, sensu.CheckStateOK},
+		{5, 1, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		plugin.ExpectTaskCount = map[string]int{"etl": tt.expected}
+		plugin.TaskCountTolerance = tt.tolerance
+		health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+		if health.Status != tt.status {
+			t.Errorf("expected %d±%d: expected state %d, got %d (%v)", tt.expected, tt.tolerance, tt.status, health.Status, health.Error)
+		}
+	}
+}
+
+func TestInMaintenanceWindow(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	tests := []struct {
+		window   string
+		time     string
+		expected bool
+	}{
+		{"", "12:00", true},
+		{"01:00-03:00", "02:30", true},
+		{"01:00-03:00", "03:00", false},
+		{"01:00-03:00", "00:59", false},
+		{"22:00-02:00", "23:15", true},
+		{"22:00-02:00", "01:59", true},
+		{"22:00-02:00", "12:00", false},
+	}
+
+	for _, tt := range tests {
+		plugin.MaintenanceWindow = tt.window
+		now, _ := time.Parse("15:04", tt.time)
+		if actual := inMaintenanceWindow(now); actual != tt.expected {
+			t.Errorf("window %q at %s: expected %v, got %v", tt.window, tt.time, tt.expected, actual)
+		}
+	}
+}
+
+func TestCheckDagHealthMaintenance(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "<html>Down for maintenance</html>")
+	}))
+	plugin.Dags = []string{"etl"}
+
+	status, _, _ := checkDagHealth(io.Discard)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected critical without maintenance awareness, got %d", status)
+	}
+
+	plugin.MaintenanceAware = true
+	var output bytes.Buffer
+	status, _, _ = checkDagHealth(&output)
+	if status != sensu.CheckStateOK {
+		t.Errorf("expected ok in maintenance, got %d", status)
+	}
+	if output.String() != "Airflow in maintenance\n" {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestCheckManifest(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags": `{"dags": [{"dag_id": "etl"}, {"dag_id": "adhoc"}], "total_entries": 2}`,
+	}))
+
+	plugin.ManifestFile = filepath.Join(t.TempDir(), "manifest")
+	if err := os.WriteFile(plugin.ManifestFile, []byte("# production DAGs\netl\n\nreport\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	findings := checkManifest(context.Background(), testAPI(http.DefaultClient), nil)
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %d", len(findings))
+	}
+	if findings[0].Status != sensu.CheckStateWarning || !strings.Contains(findings[0].Message, "adhoc") {
+		t.Errorf("unexpected untracked finding: %+v", findings[0])
+	}
+	if findings[1].Status != sensu.CheckStateCritical || !strings.Contains(findings[1].Message, "report") {
+		t.Errorf("unexpected undeployed finding: %+v", findings[1])
+	}
+}
+
+func TestCheckDagHealthManifestDiscovery(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     []string
+		expected int
+	}{
+		{"unfiltered discovery", nil, 1},
+		{"filtered discovery", []string{"etl"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lists := 0
+			handler := routes(map[string]string{
+				"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			})
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the credentials probe lists a single DAG
+				if r.URL.Path == "/api/v1/dags" && r.URL.Query().Get("limit") != "1" {
+					lists++
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			plugin.Tags = tt.tags
+			plugin.ManifestFile = filepath.Join(t.TempDir(), "manifest")
+			if err := os.WriteFile(plugin.ManifestFile, []byte("etl\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			status, _, err := checkDagHealth(io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != sensu.CheckStateOK {
+				t.Errorf("expected ok, got %d", status)
+			}
+			if lists != tt.expected {
+				t.Errorf("expected the DAGs to be listed %d times, got %d", tt.expected, lists)
+			}
+		})
+	}
+}
+
+func TestCheckDagFailureReason(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/etl":                                        `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":                                `{"dag_runs": [{"dag_id": "etl", "dag_run_id": "run1", "state": "failed", "execution_date": "2024-06-01T12:00:00+00:00", "note": "upstream outage"}], "total_entries": 1}`,
+		"/api/v1/dags/etl/dagRuns/run1/taskInstances":             `{"task_instances": [{"task_id": "load", "state": "failed", "try_number": 2}], "total_entries": 1}`,
+		"/api/v1/dags/etl/dagRuns/run1/taskInstances/load/logs/2": "starting\nValueError: bad row",
+	}))
+	plugin.IncludeLogs = true
+	plugin.LogBytes = 20
+
+	health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical {
+		t.Fatalf("expected critical, got %d", health.Status)
+	}
+
+	expected := "DAG failed its last execution: etl run run1 at 2024-06-01T12:00:00Z\nNote: upstream outage\nFailed task: load\nValueError: bad row"
+	if health.Error.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, health.Error.Error())
+	}
+}
+
+func TestWeightedRollup(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.DimensionWeights = map[string]int{"dags": 1, "scheduler": 4}
+	scheduler := Finding{Dimension: "scheduler", Status: sensu.CheckStateCritical}
+	healthy := Finding{Dimension: "scheduler", Status: sensu.CheckStateOK}
+
+	tests := []struct {
+		dagStatus int
+		findings  []Finding
+		expected  int
+	}{
+		{sensu.CheckStateOK, []Finding{scheduler}, sensu.CheckStateCritical},
+		{sensu.CheckStateCritical, []Finding{healthy}, sensu.CheckStateOK},
+		{sensu.CheckStateUnknown, nil, sensu.CheckStateCritical},
+		{sensu.CheckStateWarning, []Finding{{Dimension: "inventory", Status: sensu.CheckStateOK}}, sensu.CheckStateWarning},
+	}
+
+	for i, tt := range tests {
+		if actual, _ := weightedRollup(tt.dagStatus, tt.findings); actual != tt.expected {
+			t.Errorf("case %d: expected %d, got %d", i, tt.expected, actual)
+		}
+	}
+}
+
+func TestCheckDagHealthWeightedHealth(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduler string
+		state     string
+		expected  int
+		score     string
+	}{
+		{"unhealthy scheduler", "unhealthy", "success", sensu.CheckStateCritical, "Weighted health score: 1.60\n"},
+		{"failed DAG", "healthy", "failed", sensu.CheckStateOK, "Weighted health score: 0.40\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/health":           fmt.Sprintf(`{"metadatabase": {"status": "healthy"}, "scheduler": {"status": "%s"}}`, tt.scheduler),
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": fmt.Sprintf(`{"dag_runs": [{"dag_run_id": "r1", "state": "%s"}], "total_entries": 1}`, tt.state),
+			}))
+			// the example of the README
+			plugin.Dags = []string{"etl"}
+			plugin.CheckHealth = true
+			plugin.DimensionWeights = map[string]int{"dags": 1, "health": 4}
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected || !strings.HasSuffix(output.String(), tt.score) {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.score, status, output.String())
+			}
+		})
+	}
+}
+
+func TestRecordTrend(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.TrendFile = filepath.Join(t.TempDir(), "trend")
+	plugin.TrendWindow = 3600
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	history := "2024-01-01T10:00:00Z 50\n2024-01-01T11:15:00Z 97\n2024-01-01T11:45:00Z 95\n"
+	if err := os.WriteFile(plugin.TrendFile, []byte(history), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	trend, err := recordTrend(now, 92)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Health 92%, down 5% over the last 1h0m0s"; trend != expected {
+		t.Errorf("expected %q, got %q", expected, trend)
+	}
+
+	body, _ := os.ReadFile(plugin.TrendFile)
+	if !strings.HasSuffix(string(body), "2024-01-01T12:00:00Z 92\n") {
+		t.Errorf("expected the run to be appended, got %q", string(body))
+	}
+}
+
+func TestGetAllDagsPaginates(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dags []string
+		switch r.URL.Query().Get("offset") {
+		case "0":
+			for i := 0; i < dagPageLimit; i++ {
+				dags = append(dags, fmt.Sprintf(`{"dag_id": "dag_%d"}`, i))
+			}
+		case fmt.Sprint(dagPageLimit):
+			dags = append(dags, `{"dag_id": "last"}`)
+		}
+		fmt.Fprintf(w, `{"dags": [%s], "total_entries": %d}`, strings.Join(dags, ","), dagPageLimit+1)
+	}))
+
+	dagList, err := testAPI(http.DefaultClient).getAllDags(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dagList.Dags) != dagPageLimit+1 {
+		t.Fatalf("expected %d DAGs, got %d", dagPageLimit+1, len(dagList.Dags))
+	}
+	if dagList.Dags[dagPageLimit].DagId != "last" {
+		t.Errorf("expected the last DAG from the second page, got %s", dagList.Dags[dagPageLimit].DagId)
+	}
+}
+
+func TestCheckDagNotFound(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"title": "DAG not found"}`)
+		case "/api/v1/dags/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"title": "Forbidden", "detail": "insufficient permissions"}`)
+		}
+	}))
+
+	health := checkDag(context.Background(), "missing", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateWarning || health.Error.Error() != "requested DAG 'missing' not found on server" {
+		t.Errorf("unexpected health for a missing DAG: %d %v", health.Status, health.Error)
+	}
+
+	health = checkDag(context.Background(), "missing", false, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateWarning || health.Error.Error() != "DAG does not exist: missing" {
+		t.Errorf("unexpected health for a discovered DAG gone missing: %d %v", health.Status, health.Error)
+	}
+
+	plugin.NotFoundState = "critical"
+	health = checkDag(context.Background(), "missing", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical {
+		t.Errorf("expected --not-found-state to apply, got %d", health.Status)
+	}
+
+	health = checkDag(context.Background(), "broken", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical || !strings.HasPrefix(health.Error.Error(), "could not retrieve DAG: broken") {
+		t.Errorf("expected a retrieval error to stay critical, got %d %v", health.Status, health.Error)
+	}
+
+	health = checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical || !strings.Contains(health.Error.Error(), "403 Forbidden: {\"title\": \"Forbidden\"") {
+		t.Errorf("expected the status and body in the error, got %v", health.Error)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.InsecureSkipVerify = false
+	if transport := newTransport(plugin); transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("expected certificate verification to be enabled")
+	}
+
+	plugin.InsecureSkipVerify = true
+	if transport := newTransport(plugin); transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("expected certificate verification to be skipped")
+	}
+
+	if config := http.DefaultTransport.(*http.Transport).TLSClientConfig; config != nil && config.InsecureSkipVerify {
+		t.Error("expected http.DefaultTransport to be untouched")
+	}
+}
+
+func TestNewTransportConnections(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	defaults := http.DefaultTransport.(*http.Transport)
+	if transport := newTransport(plugin); transport.MaxIdleConns != defaults.MaxIdleConns || transport.DisableKeepAlives {
+		t.Errorf("expected the default connection settings, got %d %t", transport.MaxIdleConns, transport.DisableKeepAlives)
+	}
+
+	plugin.MaxIdleConns = 20
+	plugin.DisableKeepAlives = true
+	transport := newTransport(plugin)
+	if transport.MaxIdleConns != 20 || transport.MaxIdleConnsPerHost != 20 || !transport.DisableKeepAlives {
+		t.Errorf("expected the configured connection settings, got %d %d %t", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.DisableKeepAlives)
+	}
+}
+
+func TestCACert(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if plugin.rootCAs, err = loadCACert(bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: newTransport(plugin)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the CA bundle to be trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCACert(invalid); err == nil {
+		t.Error("expected an error for a bundle without certificates")
+	}
+	if _, err := loadCACert(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected an error for a missing bundle")
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sensu"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	plugin.ClientCert = filepath.Join(dir, "client.pem")
+	plugin.ClientKey = filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(plugin.ClientCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(plugin.ClientKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatal(err)
+	}
+	config := newTransport(plugin).TLSClientConfig
+	if config == nil || len(config.Certificates) != 1 || !bytes.Equal(config.Certificates[0].Certificate[0], der) {
+		t.Errorf("expected the client certificate in the transport, got %+v", config)
+	}
+
+	plugin.ClientKey = ""
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Error("expected --client-cert without --client-key to be rejected")
+	}
+}
+
+func TestExecuteCheckLeavesDefaultClient(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags": `{"dags": [], "total_entries": 0}`,
+	}))
+	plugin.Output = outputText
+
+	transport := http.DefaultTransport
+	if _, err := executeCheck(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if http.DefaultClient.Transport != nil || http.DefaultClient.Timeout != 0 {
+		t.Error("expected http.DefaultClient to be untouched")
+	}
+	if http.DefaultTransport != transport {
+		t.Error("expected http.DefaultTransport to be untouched")
+	}
+}
+
+func TestCredentialsAuthorize(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "secret"
+
+	req := httptest.NewRequest("GET", "/api/v1/dags", nil)
+	newCredentials(plugin).authorize(req)
+	if username, password, ok := req.BasicAuth(); !ok || username != "admin" || password != "secret" {
+		t.Errorf("expected basic auth, got %q", req.Header.Get("Authorization"))
+	}
+
+	plugin.AirflowUsername = ""
+	plugin.AirflowPassword = ""
+	plugin.Token = "jwt"
+
+	req = httptest.NewRequest("GET", "/api/v1/dags", nil)
+	newCredentials(plugin).authorize(req)
+	if auth := req.Header.Get("Authorization"); auth != "Bearer jwt" {
+		t.Errorf("expected bearer auth, got %q", auth)
+	}
+
+	plugin.NoAuth = true
+	req = httptest.NewRequest("GET", "/api/v1/dags", nil)
+	newCredentials(plugin).authorize(req)
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		t.Errorf("expected no credentials with --no-auth, got %q", auth)
+	}
+}
+
+func TestCheckArgsUrl(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+
+	tests := []struct {
+		url   string
+		error string
+	}{
+		{"localhost:8080", "must start with http:// or https://"},
+		{"ftp://airflow.example.com/", "must start with http:// or https://"},
+		{"http:///api/v1", "must include a host"},
+		{"https://airflow.example.com/", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			plugin.AirflowApiUrl = tt.url
+			status, err := checkArgs(nil)
+			if tt.error == "" && err != nil {
+				t.Errorf("expected a valid URL, got %v", err)
+			} else if tt.error != "" && (status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), tt.error)) {
+				t.Errorf("expected a warning with %q, got %d %v", tt.error, status, err)
+			}
+		})
+	}
+
+	plugin.Output = outputText
+	plugin.AirflowApiUrls = []string{"https://us.example.com/", "https://eu.example.com/"}
+	plugin.AirflowUsernames = []string{"admin"}
+	if _, err := checkArgs(nil); err == nil || !strings.Contains(err.Error(), "--usernames") {
+		t.Errorf("expected an error for unmatched usernames, got %v", err)
+	}
+}
+
+func TestNormalizeDagIds(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected []string
+		empty    int
+	}{
+		{"comma separated", []string{"etl,report"}, []string{"etl", "report"}, 0},
+		{"surrounding whitespace", []string{" etl", "report "}, []string{"etl", "report"}, 0},
+		{"comma separated with whitespace", []string{"etl, report"}, []string{"etl", "report"}, 0},
+		{"duplicates", []string{"etl", "report", "etl,report"}, []string{"etl", "report"}, 0},
+		{"empty entries", []string{"etl,", " "}, []string{"etl"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dagIds, empty := normalizeDagIds(tt.values)
+			if strings.Join(dagIds, "|") != strings.Join(tt.expected, "|") || empty != tt.empty {
+				t.Errorf("expected %q with %d empty, got %q with %d", tt.expected, tt.empty, dagIds, empty)
+			}
+		})
+	}
+}
+
+func TestCheckArgsAuth(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+	plugin.AirflowUsername = ""
+	plugin.AirflowPassword = ""
+	plugin.Token = ""
+
+	if _, err := checkArgs(nil); err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	plugin.Token = "jwt"
+	if _, err := checkArgs(nil); err != nil {
+		t.Errorf("expected the token to be sufficient, got %v", err)
+	}
+
+	plugin.Token = ""
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	if _, err := checkArgs(nil); err != nil {
+		t.Errorf("expected basic auth to be sufficient, got %v", err)
+	}
+
+	plugin.AirflowUsername = ""
+	plugin.AirflowPassword = ""
+	plugin.NoAuth = true
+	if _, err := checkArgs(nil); err != nil {
+		t.Errorf("expected no credentials to be required with --no-auth, got %v", err)
+	}
+}
+
+func TestCredentialsFromEnv(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	t.Setenv("AIRFLOW_API_URL", "https://airflow.example.com/")
+	t.Setenv("AIRFLOW_USERNAME", "env-user")
+	t.Setenv("AIRFLOW_PASSWORD", "env-secret")
+
+	parse := func(args ...string) {
+		t.Helper()
+		cmd := &cobra.Command{}
+		for _, opt := range options {
+			if err := opt.SetupFlag(cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parse()
+	if plugin.AirflowApiUrl != "https://airflow.example.com/" || plugin.AirflowUsername != "env-user" || plugin.AirflowPassword != "env-secret" {
+		t.Errorf("expected the options from the environment, got %s %s %s", plugin.AirflowApiUrl, plugin.AirflowUsername, plugin.AirflowPassword)
+	}
+
+	parse("--username", "flag-user")
+	if plugin.AirflowUsername != "flag-user" {
+		t.Errorf("expected the flag to override the environment, got %s", plugin.AirflowUsername)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	saved := plugin
+	savedStderr := stderr
+	defer func() {
+		plugin = saved
+		stderr = savedStderr
+	}()
+	var warnings bytes.Buffer
+	stderr = &warnings
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": `
+url: https://airflow.example.com/
+dag:
+  - etl
+  - report
+dag-severity:
+  Report: warning
+timeout: 30
+no-such-option: true
+`,
+		"config.json": `{"url": "https://airflow.example.com/", "dag": ["etl", "report"], "dag-severity": {"Report": "warning"}, "timeout": 30, "no-such-option": true}`,
+	}
+
+	parse := func(path string, args ...string) {
+		t.Helper()
+		cmd := &cobra.Command{}
+		for _, opt := range options {
+			if err := opt.SetupFlag(cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := applyConfigFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, body := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			warnings.Reset()
+			parse(path)
+			if plugin.AirflowApiUrl != "https://airflow.example.com/" || strings.Join(plugin.Dags, ",") != "etl,report" || plugin.DagSeverity["Report"] != "warning" || plugin.Timeout != 30 {
+				t.Errorf("expected the options from the file, got %s %v %v %d", plugin.AirflowApiUrl, plugin.Dags, plugin.DagSeverity, plugin.Timeout)
+			}
+			if !strings.Contains(warnings.String(), "Ignoring unknown option no-such-option") {
+				t.Errorf("expected a warning for the unknown key, got %q", warnings.String())
+			}
+
+			parse(path, "--dag", "cleanup", "--url", "https://other.example.com/")
+			if plugin.AirflowApiUrl != "https://other.example.com/" || strings.Join(plugin.Dags, ",") != "cleanup" {
+				t.Errorf("expected the flags to override the file, got %s %v", plugin.AirflowApiUrl, plugin.Dags)
+			}
+			if plugin.Timeout != 30 {
+				t.Errorf("expected the options not given as flags to be kept, got %d", plugin.Timeout)
+			}
+		})
+	}
+
+	if path := configFileArg([]string{"--dag", "etl", "--config-file", "a.yaml"}); path != "a.yaml" {
+		t.Errorf("expected a.yaml, got %q", path)
+	}
+	if path := configFileArg([]string{"--config-file=b.json"}); path != "b.json" {
+		t.Errorf("expected b.json, got %q", path)
+	}
+}
+
+func TestCheckArgsPasswordFile(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+	plugin.AirflowUsername = "admin"
+	plugin.Token = ""
+
+	dir := t.TempDir()
+	plugin.PasswordFile = filepath.Join(dir, "password")
+	if err := os.WriteFile(plugin.PasswordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin.AirflowPassword = "admin"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Error("expected --password and --password-file to be mutually exclusive")
+	}
+
+	plugin.AirflowPassword = ""
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.AirflowPassword != "secret" {
+		t.Errorf("expected the password from the file, got %q", plugin.AirflowPassword)
+	}
+
+	plugin.AirflowPassword = ""
+	plugin.PasswordFile = filepath.Join(dir, "missing")
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), plugin.PasswordFile) {
+		t.Errorf("expected a warning naming the missing file, got %v", err)
+	}
+}
+
+func TestCheckDagLatestRunOrder(t *testing.T) {
+	runs := []string{
+		`{"dag_id": "etl", "dag_run_id": "oldest", "state": "success", "execution_date": "2024-01-01T00:00:00Z"}`,
+		`{"dag_id": "etl", "dag_run_id": "previous", "state": "success", "execution_date": "2024-01-02T00:00:00Z"}`,
+		`{"dag_id": "etl", "dag_run_id": "newest", "state": "failed", "execution_date": "2024-01-03T00:00:00Z"}`,
+	}
+
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			// the API returns runs in ascending order unless asked otherwise
+			ordered := runs
+			if r.URL.Query().Get("order_by") == "-execution_date" {
+				ordered = []string{runs[2], runs[1], runs[0]}
+			}
+			fmt.Fprintf(w, `{"dag_runs": [%s], "total_entries": 3}`, ordered[0])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical || health.DagRunId != "newest" {
+		t.Errorf("expected the newest failed run to be critical, got %d for %s", health.Status, health.DagRunId)
+	}
+}
+
+func TestCheckDagFailureThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		runs     string
+		expected int
+	}{
+		{"one failure after a success", `{"state": "failed"}, {"state": "success"}`, sensu.CheckStateOK},
+		{"consecutive failures", `{"state": "failed"}, {"state": "failed"}, {"state": "failed"}`, sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/dags/etl":
+					fmt.Fprint(w, `{"dag_id": "etl"}`)
+				case "/api/v1/dags/etl/dagRuns":
+					fmt.Fprintf(w, `{"dag_runs": [%s], "total_entries": 3}`, tt.runs)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			plugin.FailureThreshold = 2
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagFailureThresholdSelection(t *testing.T) {
+	tests := []struct {
+		name         string
+		runConfMatch map[string]string
+		since        int
+		expected     int
+	}{
+		{"all runs", nil, 0, sensu.CheckStateOK},
+		{"runs matching the conf", map[string]string{"tenant": "acme"}, 0, sensu.CheckStateCritical},
+		{"runs within the window", nil, 7200, sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/dags/etl":
+					fmt.Fprint(w, `{"dag_id": "etl"}`)
+				case "/api/v1/dags/etl/dagRuns":
+					// the successful run of another tenant falls outside the window
+					if r.URL.Query().Get("execution_date_gte") != "" {
+						fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r3", "state": "failed", "conf": {"tenant": "acme"}}, {"dag_run_id": "r1", "state": "failed", "conf": {"tenant": "acme"}}], "total_entries": 2}`)
+						return
+					}
+					fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r3", "state": "failed", "conf": {"tenant": "acme"}}, {"dag_run_id": "r2", "state": "success", "conf": {"tenant": "globex"}}, {"dag_run_id": "r1", "state": "failed", "conf": {"tenant": "acme"}}], "total_entries": 3}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			plugin.FailureThreshold = 2
+			plugin.RunConfMatch = tt.runConfMatch
+			plugin.Since = tt.since
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagFailureThresholdHistoryLimit(t *testing.T) {
+	var limits []string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			limits = append(limits, r.URL.Query().Get("limit"))
+			fmt.Fprint(w, `{"dag_runs": [{"state": "failed"}, {"state": "failed"}, {"state": "failed"}], "total_entries": 5}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.FailureThreshold = 5
+	plugin.HistoryLimit = 3
+
+	health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateOK {
+		t.Errorf("expected the failures within the history limit to stay below the threshold, got %d (%v)", health.Status, health.Error)
+	}
+	if len(limits) != 2 || limits[1] != "3" {
+		t.Errorf("expected the streak to be fetched within the history limit, got limits %v", limits)
+	}
+}
+
+func TestCheckDagSeverity(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/audit":           `{"dag_id": "audit"}`,
+		"/api/v1/dags/audit/dagRuns":   `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+		"/api/v1/dags/billing":         `{"dag_id": "billing"}`,
+		"/api/v1/dags/billing/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+	}))
+	plugin.DagSeverity = map[string]string{"audit": "warning"}
+
+	if health := checkDag(context.Background(), "audit", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateWarning {
+		t.Errorf("expected the overridden DAG to be a warning, got %d (%v)", health.Status, health.Error)
+	}
+	if health := checkDag(context.Background(), "billing", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateCritical {
+		t.Errorf("expected the DAG without override to be critical, got %d (%v)", health.Status, health.Error)
+	}
+}
+
+func TestCheckDagTagSeverity(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/report":          `{"dag_id": "report", "tags": [{"name": "reporting"}]}`,
+		"/api/v1/dags/report/dagRuns":  `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+		"/api/v1/dags/billing":         `{"dag_id": "billing", "tags": [{"name": "reporting"}, {"name": "finance"}]}`,
+		"/api/v1/dags/billing/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+	}))
+	plugin.TagSeverity = map[string]string{"reporting": "warning", "finance": "critical"}
+
+	if health := checkDag(context.Background(), "report", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateWarning {
+		t.Errorf("expected the tag to downgrade the DAG to a warning, got %d (%v)", health.Status, health.Error)
+	}
+	if health := checkDag(context.Background(), "billing", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateCritical {
+		t.Errorf("expected the most severe tag to win, got %d (%v)", health.Status, health.Error)
+	}
+}
+
+func TestCheckDagTasks(t *testing.T) {
+	tests := []struct {
+		name     string
+		tasks    string
+		expected int
+	}{
+		{"all tasks succeeded", `{"task_instances": [], "total_entries": 0}`, sensu.CheckStateOK},
+		{"one failed task", `{"task_instances": [{"task_id": "load", "state": "failed"}], "total_entries": 1}`, sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var states []string
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/dags/etl":
+					fmt.Fprint(w, `{"dag_id": "etl"}`)
+				case "/api/v1/dags/etl/dagRuns":
+					fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`)
+				case "/api/v1/dags/etl/dagRuns/r1/taskInstances":
+					states = r.URL.Query()["state"]
+					fmt.Fprint(w, tt.tasks)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			plugin.CheckTasks = true
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+			if strings.Join(states, ",") != "failed,upstream_failed" {
+				t.Errorf("unexpected task states requested: %v", states)
+			}
+		})
+	}
+}
+
+func TestCheckDagSla(t *testing.T) {
+	tests := []struct {
+		name     string
+		misses   string
+		expected int
+		message  string
+	}{
+		{"no misses", `{"sla_misses": [], "total_entries": 0}`, sensu.CheckStateOK, ""},
+		{"multiple misses", `{"sla_misses": [
+			{"task_id": "extract", "execution_date": "2023-01-02T00:00:00Z"},
+			{"task_id": "load", "execution_date": "2023-01-02T00:00:00Z"},
+			{"task_id": "report", "execution_date": "2023-01-01T00:00:00Z"}
+		], "total_entries": 3}`, sensu.CheckStateWarning, "DAG run missed the SLA of 2 tasks: etl r2 (extract, load)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":           `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns":   `{"dag_runs": [{"dag_run_id": "r2", "state": "success", "execution_date": "2023-01-02T00:00:00Z"}], "total_entries": 1}`,
+				"/api/v1/dags/etl/slaMisses": tt.misses,
+			}))
+			plugin.CheckSla = true
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+			if tt.message != "" && (health.Error == nil || health.Error.Error() != tt.message) {
+				t.Errorf("unexpected message: %v", health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagRunConfMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		runs     string
+		expected int
+	}{
+		{"matching failed run", `{"dag_run_id": "r2", "state": "success", "conf": {"tenant": "globex"}}, {"dag_run_id": "r1", "state": "failed", "conf": {"tenant": "acme"}}`, sensu.CheckStateCritical},
+		{"non-matching failed run", `{"dag_run_id": "r2", "state": "failed", "conf": {"tenant": "globex"}}, {"dag_run_id": "r1", "state": "success", "conf": {"tenant": "acme"}}`, sensu.CheckStateOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": fmt.Sprintf(`{"dag_runs": [%s], "total_entries": 2}`, tt.runs),
+			}))
+			plugin.HistoryLimit = 10
+			plugin.RunConfMatch = map[string]string{"tenant": "acme"}
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected || health.DagRunId != "r1" {
+				t.Errorf("expected %d for run r1, got %d for %s (%v)", tt.expected, health.Status, health.DagRunId, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagRunId(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      string
+		expected int
+		message  string
+	}{
+		{"succeeded run", `{"dag_run_id": "deploy", "state": "success"}`, sensu.CheckStateOK, ""},
+		{"failed run", `{"dag_run_id": "deploy", "state": "failed"}`, sensu.CheckStateCritical, "DAG failed its last execution: etl run deploy"},
+		{"missing run", ``, sensu.CheckStateCritical, "DAG run does not exist: etl deploy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "latest", "state": "success"}], "total_entries": 2}`,
+			}
+			if tt.run != "" {
+				responses["/api/v1/dags/etl/dagRuns/deploy"] = tt.run
+			}
+			useServer(t, routes(responses))
+			plugin.DagRunId = "deploy"
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+			if tt.message != "" && (health.Error == nil || !strings.HasPrefix(health.Error.Error(), tt.message)) {
+				t.Errorf("expected %q, got %v", tt.message, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagRequireRuns(t *testing.T) {
+	tests := []struct {
+		name        string
+		requireRuns bool
+		explicit    bool
+		expected    int
+	}{
+		{"explicit DAG without the flag", false, true, sensu.CheckStateOK},
+		{"explicit DAG with the flag", true, true, sensu.CheckStateWarning},
+		{"discovered DAG with the flag", true, false, sensu.CheckStateOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+			}))
+			plugin.RequireRuns = tt.requireRuns
+
+			health := checkDag(context.Background(), "etl", tt.explicit, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+			if tt.expected == sensu.CheckStateWarning && (health.Error == nil || health.Error.Error() != "DAG has never run: etl") {
+				t.Errorf("unexpected error: %v", health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagSkipActiveRuns(t *testing.T) {
+	runs := []string{
+		`{"dag_run_id": "r3", "state": "running"}`,
+		`{"dag_run_id": "r2", "state": "queued"}`,
+		`{"dag_run_id": "r1", "state": "failed"}`,
+	}
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			end := offset + limit
+			if end > len(runs) {
+				end = len(runs)
+			}
+			fmt.Fprintf(w, `{"dag_runs": [%s], "total_entries": %d}`, strings.Join(runs[offset:end], ", "), len(runs))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.HistoryLimit = 2
+
+	health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateOK || health.DagRunId != "r3" {
+		t.Errorf("expected the running run to be evaluated, got %d for %s (%v)", health.Status, health.DagRunId, health.Error)
+	}
+
+	plugin.SkipActiveRuns = true
+	health = checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical || health.DagRunId != "r1" {
+		t.Errorf("expected the failed run behind the active runs to be critical, got %d for %s (%v)", health.Status, health.DagRunId, health.Error)
+	}
+}
+
+func TestCheckDagSkipActiveRunsFailureThreshold(t *testing.T) {
+	runs := []string{
+		`{"dag_run_id": "r3", "state": "running"}`,
+		`{"dag_run_id": "r2", "state": "failed"}`,
+		`{"dag_run_id": "r1", "state": "failed"}`,
+	}
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			end := offset + limit
+			if end > len(runs) {
+				end = len(runs)
+			}
+			fmt.Fprintf(w, `{"dag_runs": [%s], "total_entries": %d}`, strings.Join(runs[offset:end], ", "), len(runs))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.SkipActiveRuns = true
+	plugin.FailureThreshold = 2
+
+	health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateCritical || health.DagRunId != "r2" {
+		t.Errorf("expected the failures behind the active run to reach the threshold, got %d for %s (%v)", health.Status, health.DagRunId, health.Error)
+	}
+}
+
+func TestCheckDagMaxRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		tasks    string
+		expected int
+	}{
+		{"low retries", `{"task_id": "extract", "state": "up_for_retry", "try_number": 2}, {"task_id": "load", "state": "success", "try_number": 5}`, sensu.CheckStateOK},
+		{"retries exceeded", `{"task_id": "extract", "state": "up_for_retry", "try_number": 4}, {"task_id": "load", "state": "queued", "try_number": 1}`, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":                          `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns":                  `{"dag_runs": [{"dag_run_id": "r1", "state": "running"}], "total_entries": 1}`,
+				"/api/v1/dags/etl/dagRuns/r1/taskInstances": fmt.Sprintf(`{"task_instances": [%s], "total_entries": 2}`, tt.tasks),
+			}))
+			plugin.MaxRetries = 2
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+			if tt.expected == sensu.CheckStateWarning && !strings.Contains(health.Error.Error(), "(extract 3 retries)") {
+				t.Errorf("unexpected error: %v", health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagMinRuns(t *testing.T) {
+	tests := []struct {
+		name     string
+		runs     string
+		expected int
+	}{
+		{"never ran", `{"dag_runs": [], "total_entries": 0}`, sensu.CheckStateWarning},
+		{"meets the minimum", `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`, sensu.CheckStateOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": tt.runs,
+			}))
+			plugin.MinRuns = 1
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagRunsError(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/broken", "/api/v1/dags/new":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/new/dagRuns":
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	health := checkDag(context.Background(), "broken", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateUnknown || !strings.HasPrefix(health.Error.Error(), "could not retrieve DAG runs: broken") {
+		t.Errorf("expected unknown when the runs cannot be retrieved, got %d (%v)", health.Status, health.Error)
+	}
+
+	health = checkDag(context.Background(), "new", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateOK || health.Error != nil {
+		t.Errorf("expected a DAG that never ran to be OK, got %d (%v)", health.Status, health.Error)
+	}
+}
+
+func TestCheckDagRunStates(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		okStates   []string
+		failStates []string
+		expected   int
+	}{
+		{"default ok state", "success", nil, nil, sensu.CheckStateOK},
+		{"custom ok state", "skipped", []string{"success", "skipped"}, nil, sensu.CheckStateOK},
+		{"custom fail state", "upstream_failed", nil, []string{"failed", "upstream_failed"}, sensu.CheckStateCritical},
+		{"neither ok nor failed", "skipped", nil, nil, sensu.CheckStateUnknown},
+		{"still running", "running", nil, nil, sensu.CheckStateOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": fmt.Sprintf(`{"dag_runs": [{"dag_run_id": "r1", "state": %q}], "total_entries": 1}`, tt.state),
+			}))
+			if tt.okStates != nil {
+				plugin.OkStates = tt.okStates
+			}
+			if tt.failStates != nil {
+				plugin.FailStates = tt.failStates
+			}
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagDowngradeFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     string
+		downgrade bool
+		expected  int
+	}{
+		{"failed", "failed", false, sensu.CheckStateCritical},
+		{"failed downgraded", "failed", true, sensu.CheckStateWarning},
+		{"unexpected state", "skipped", false, sensu.CheckStateUnknown},
+		{"unexpected state with downgraded failures", "skipped", true, sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": fmt.Sprintf(`{"dag_runs": [{"dag_run_id": "r1", "state": %q}], "total_entries": 1}`, tt.state),
+			}))
+			plugin.DowngradeFailures = tt.downgrade
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagSince(t *testing.T) {
+	tests := []struct {
+		name     string
+		runs     string
+		expected int
+		message  string
+	}{
+		{"run in the window", `{"dag_run_id": "r1", "state": "success"}`, sensu.CheckStateOK, ""},
+		{"empty window", ``, sensu.CheckStateWarning, "no run in the last 2h0m0s: etl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gte string
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/dags/etl":
+					fmt.Fprint(w, `{"dag_id": "etl"}`)
+				case "/api/v1/dags/etl/dagRuns":
+					gte = r.URL.Query().Get("execution_date_gte")
+					fmt.Fprintf(w, `{"dag_runs": [%s], "total_entries": 1}`, tt.runs)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			plugin.Since = 7200
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+			if tt.message != "" && (health.Error == nil || health.Error.Error() != tt.message) {
+				t.Errorf("unexpected message: %v", health.Error)
+			}
+
+			since, err := time.Parse(time.RFC3339, gte)
+			if err != nil {
+				t.Fatalf("expected execution_date_gte in the request: %v", err)
+			}
+			if offset := time.Since(since); offset < 2*time.Hour || offset > 2*time.Hour+time.Minute {
+				t.Errorf("expected the window to start 2h ago, got %s", offset)
+			}
+		})
+	}
+}
+
+func TestCheckDagMaxRunDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		started  time.Time
+		expected int
+	}{
+		{"fresh run", time.Now().Add(-time.Minute), sensu.CheckStateOK},
+		{"stale run", time.Now().Add(-3 * time.Hour), sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": fmt.Sprintf(`{"dag_runs": [{"dag_id": "etl", "dag_run_id": "run1", "state": "running", "start_date": %q}], "total_entries": 1}`, tt.started.UTC().Format(time.RFC3339)),
+			}))
+			plugin.MaxRunDuration = 3600
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagMaxAge(t *testing.T) {
+	run := func(ended time.Time) string {
+		return fmt.Sprintf(`{"dag_runs": [{"dag_id": "etl", "dag_run_id": "run1", "state": "success", "end_date": %q}], "total_entries": 1}`, ended.UTC().Format(time.RFC3339))
+	}
+
+	tests := []struct {
+		name     string
+		runs     string
+		expected int
+	}{
+		{"recent run", run(time.Now().Add(-10 * time.Minute)), sensu.CheckStateOK},
+		{"stale run", run(time.Now().Add(-2 * time.Hour)), sensu.CheckStateWarning},
+		{"never run", `{"dag_runs": [], "total_entries": 0}`, sensu.CheckStateOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": tt.runs,
+			}))
+			plugin.MaxAge = 3600
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthTags(t *testing.T) {
+	var tags []string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			tags = r.URL.Query()["tags"]
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl", "tags": [{"name": "critical"}]}], "total_entries": 1}`)
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.Tags = []string{"critical", "team:data"}
+
+	_, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "critical,team:data" {
+		t.Errorf("expected the tags in the request, got %v", tags)
+	}
+	if len(summary.Dags) != 1 || summary.Dags[0].DagId != "etl" {
+		t.Errorf("expected only the tagged DAG to be checked, got %+v", summary.Dags)
+	}
+}
+
+func TestCheckDagHealthOnlyActive(t *testing.T) {
+	var paused string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			paused = r.URL.Query().Get("paused")
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl"}, {"dag_id": "legacy", "is_paused": true}], "total_entries": 2}`)
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.OnlyActive = true
+
+	_, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paused != "false" {
+		t.Errorf("expected paused=false in the request, got %q", paused)
+	}
+	if len(summary.Dags) != 1 || summary.Dags[0].DagId != "etl" {
+		t.Errorf("expected the paused DAG to be excluded, got %+v", summary.Dags)
+	}
+}
+
+func TestCheckDagWarnOnPaused(t *testing.T) {
+	tests := []struct {
+		name         string
+		explicit     bool
+		warnOnPaused bool
+		expected     int
+	}{
+		{"explicit", true, false, sensu.CheckStateWarning},
+		{"explicit with the flag", true, true, sensu.CheckStateWarning},
+		{"discovered", false, false, sensu.CheckStateOK},
+		{"discovered with the flag", false, true, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl", "is_paused": true}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.WarnOnPaused = tt.warnOnPaused
+
+			health := checkDag(context.Background(), "etl", tt.explicit, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthMissingDags(t *testing.T) {
+	tests := []struct {
+		name          string
+		notFoundState string
+		expected      int
+	}{
+		{"default state", "warning", sensu.CheckStateWarning},
+		{"configured state", "critical", sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested := map[string]bool{}
+			// the DAG list is served, yet the state of --not-found-state applies
+			handler := routes(map[string]string{
+				"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			})
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("limit") != "1" {
+					requested[r.URL.Path] = true
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			plugin.Dags = []string{"etl", "typo"}
+			plugin.NotFoundState = tt.notFoundState
+
+			var output bytes.Buffer
+			status, summary, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected || len(summary.Dags) != 2 {
+				t.Errorf("expected %d for the missing DAG, got %d: %q", tt.expected, status, output.String())
+			}
+			if !strings.Contains(output.String(), "typo "+stateName(tt.expected)+"\nError occurred while checking DAG:\nrequested DAG 'typo' not found on server\n") {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+			if requested["/api/v1/dags"] {
+				t.Error("expected the given DAGs to be checked without listing every DAG")
+			}
+		})
+	}
+}
+
+func TestCheckDagWarnOnNoSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		dag      string
+		expected int
+	}{
+		{"scheduled DAG", `{"dag_id": "etl", "schedule_interval": {"__type": "CronExpression", "value": "0 * * * *"}}`, sensu.CheckStateOK},
+		{"DAG without a schedule", `{"dag_id": "etl", "schedule_interval": null}`, sensu.CheckStateWarning},
+		{"paused DAG without a schedule", `{"dag_id": "etl", "is_paused": true, "schedule_interval": null}`, sensu.CheckStateOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         tt.dag,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.WarnOnNoSchedule = true
+
+			health := checkDag(context.Background(), "etl", false, testAPI(http.DefaultClient))
+			if health.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%v)", tt.expected, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthExcludeDag(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags":                               `{"dags": [{"dag_id": "etl"}, {"dag_id": "example_bash_operator"}], "total_entries": 2}`,
+		"/api/v1/dags/etl":                           `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":                   `{"dag_runs": [], "total_entries": 0}`,
+		"/api/v1/dags/example_bash_operator":         `{"dag_id": "example_bash_operator"}`,
+		"/api/v1/dags/example_bash_operator/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+	}))
+	plugin.ExcludeDags = []string{"example_bash_operator"}
+
+	_, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Dags) != 1 || summary.Dags[0].DagId != "etl" {
+		t.Errorf("expected example_bash_operator to be excluded, got %+v", summary.Dags)
+	}
+}
+
+func TestCheckDagHealthDagRegex(t *testing.T) {
+	server := routes(map[string]string{
+		"/api/v1/dags":                            `{"dags": [{"dag_id": "etl_customer_daily"}, {"dag_id": "etl_customer_hourly"}, {"dag_id": "report"}], "total_entries": 3}`,
+		"/api/v1/dags/etl_customer_daily":         `{"dag_id": "etl_customer_daily"}`,
+		"/api/v1/dags/etl_customer_daily/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+		"/api/v1/dags/report":                     `{"dag_id": "report"}`,
+		"/api/v1/dags/report/dagRuns":             `{"dag_runs": [], "total_entries": 0}`,
+	})
+
+	tests := []struct {
+		name     string
+		patterns []string
+		excludes []string
+		expected []string
+		output   string
+	}{
+		{"subset", []string{"^etl_customer_"}, nil, []string{"etl_customer_daily"}, ""},
+		{"no match", []string{"^ml_"}, nil, nil, "No DAGs matched\n"},
+		{"exclude only", nil, []string{"^etl_"}, []string{"report"}, ""},
+		{"exclude wins over include", []string{"^etl_customer_"}, []string{"_daily$"}, nil, "No DAGs matched\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, server)
+			plugin.ExcludeDags = []string{"etl_customer_hourly"}
+
+			var err error
+			if plugin.dagPatterns, err = compilePatterns(tt.patterns); err != nil {
+				t.Fatal(err)
+			}
+			if plugin.excludePatterns, err = compilePatterns(tt.excludes); err != nil {
+				t.Fatal(err)
+			}
+
+			var output bytes.Buffer
+			_, summary, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var checked []string
+			for _, h := range summary.Dags {
+				checked = append(checked, h.DagId)
+			}
+			if strings.Join(checked, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v to be checked, got %v", tt.expected, checked)
+			}
+			if tt.output != "" && output.String() != tt.output {
+				t.Errorf("expected %q, got %q", tt.output, output.String())
+			}
+		})
+	}
+}
+
+func TestCheckArgsInvalidDagRegex(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	plugin.DagRegex = []string{"etl_("}
+
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected a warning for an invalid pattern, got %d %v", status, err)
+	}
+
+	plugin.DagRegex = nil
+	plugin.ExcludeRegex = []string{"test_["}
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected a warning for an invalid exclude pattern, got %d %v", status, err)
+	}
+}
+
+func TestCheckArgsInvalidDagSeverity(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+	plugin.DagSeverity = map[string]string{"audit": "minor"}
+
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "--dag-severity") {
+		t.Errorf("expected a warning for an invalid severity, got %d %v", status, err)
+	}
+}
+
+func TestCheckInstanceHealth(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+		message  string
+	}{
+		{"healthy", `{"metadatabase": {"status": "healthy"}, "scheduler": {"status": "healthy"}}`, sensu.CheckStateOK, ""},
+		{"unhealthy scheduler", `{"metadatabase": {"status": "healthy"}, "scheduler": {"status": "unhealthy"}}`, sensu.CheckStateCritical, "scheduler"},
+		{"unreachable", "", sensu.CheckStateCritical, "could not retrieve airflow health"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := useServer(t, routes(map[string]string{"/api/v1/health": tt.body}))
+			if tt.body == "" {
+				server.Close()
+			}
+
+			finding := checkInstanceHealth(context.Background(), testAPI(http.DefaultClient))
+			if finding.Status != tt.expected || !strings.Contains(finding.Message, tt.message) {
+				t.Errorf("unexpected finding: %+v", finding)
+			}
+		})
+	}
+}
+
+func TestCheckImportErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+		files    []string
+	}{
+		{"no errors", `{"import_errors": [], "total_entries": 0}`, sensu.CheckStateOK, nil},
+		{"errors", `{"import_errors": [
+			{"filename": "/dags/etl.py", "stack_trace": "Traceback (most recent call last):\n  File \"/dags/etl.py\", line 3\nSyntaxError: invalid syntax"},
+			{"filename": "/dags/report.py", "stack_trace": "ModuleNotFoundError: No module named 'pandas'"}
+		], "total_entries": 2}`, sensu.CheckStateCritical, []string{"/dags/etl.py: SyntaxError: invalid syntax", "/dags/report.py: ModuleNotFoundError"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{"/api/v1/importErrors": tt.body}))
+
+			finding := checkImportErrors(context.Background(), testAPI(http.DefaultClient))
+			if finding.Status != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, finding.Status)
+			}
+			for _, f := range tt.files {
+				if !strings.Contains(finding.Message, f) {
+					t.Errorf("expected %q in %q", f, finding.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckConnection(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/connections/warehouse": `{"connection_id": "warehouse", "conn_type": "postgres", "host": "db"}`,
+	}))
+
+	if finding := checkConnection(context.Background(), "warehouse", testAPI(http.DefaultClient)); finding.Status != sensu.CheckStateOK {
+		t.Errorf("expected an existing connection to be OK, got %d (%s)", finding.Status, finding.Message)
+	}
+
+	finding := checkConnection(context.Background(), "s3", testAPI(http.DefaultClient))
+	if finding.Status != sensu.CheckStateCritical || finding.Message != "Connection does not exist: s3" {
+		t.Errorf("expected a missing connection to be critical, got %d (%s)", finding.Status, finding.Message)
+	}
+}
+
+func TestCheckDataset(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		expected int
+	}{
+		{"fresh dataset", 10 * time.Minute, sensu.CheckStateOK},
+		{"stale dataset", 3 * time.Hour, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query url.Values
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query()
+				timestamp := time.Now().Add(-tt.age).UTC().Format(time.RFC3339)
+				fmt.Fprintf(w, `{"dataset_events": [{"dataset_uri": "s3://lake/orders", "timestamp": "%s"}], "total_entries": 1}`, timestamp)
+			}))
+			plugin.DatasetMaxAge = 3600
+
+			finding := checkDataset(context.Background(), "s3://lake/orders", testAPI(http.DefaultClient))
+			if finding.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%s)", tt.expected, finding.Status, finding.Message)
+			}
+			if query.Get("uri") != "s3://lake/orders" {
+				t.Errorf("expected the events of the dataset to be requested, got %v", query)
+			}
+		})
+	}
+}
+
+func TestCheckPoolSlots(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     string
+		minSlots int
+		expected int
+	}{
+		{"free slots", `{"name": "default_pool", "slots": 128, "occupied_slots": 12, "open_slots": 116}`, 0, sensu.CheckStateOK},
+		{"saturated", `{"name": "default_pool", "slots": 128, "occupied_slots": 128, "open_slots": 0}`, 0, sensu.CheckStateWarning},
+		{"below the minimum", `{"name": "default_pool", "slots": 128, "occupied_slots": 124, "open_slots": 4}`, 8, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{"/api/v1/pools/default_pool": tt.pool}))
+			plugin.PoolMinSlots = tt.minSlots
+
+			finding := checkPoolSlots(context.Background(), "default_pool", testAPI(http.DefaultClient))
+			if finding.Status != tt.expected {
+				t.Errorf("expected %d, got %d (%s)", tt.expected, finding.Status, finding.Message)
+			}
+		})
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		status   int
+		expected int
+		requests int
+	}{
+		{"fails twice then succeeds", 2, http.StatusInternalServerError, http.StatusOK, 3},
+		{"not found is not retried", 1, http.StatusNotFound, http.StatusNotFound, 1},
+		{"gives up after the retries", 5, http.StatusBadGateway, http.StatusBadGateway, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= tt.failures {
+					w.WriteHeader(tt.status)
+				}
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: &retryTransport{transport: http.DefaultTransport, retries: 2, delay: time.Millisecond}}
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expected || requests != tt.requests {
+				t.Errorf("expected %d after %d requests, got %d after %d", tt.expected, tt.requests, resp.StatusCode, requests)
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthDeadline(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			fmt.Fprint(w, `{"dags": [{"dag_id": "fast"}, {"dag_id": "slow"}, {"dag_id": "never"}], "total_entries": 3}`)
+		case "/api/v1/dags/fast":
+			fmt.Fprint(w, `{"dag_id": "fast"}`)
+		case "/api/v1/dags/fast/dagRuns":
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		default:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.Dags = []string{"fast", "slow", "never"}
+	plugin.Timeout = 1
+
+	start := time.Now()
+	_, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the check to abort near the deadline, took %s", elapsed)
+	}
+
+	expected := []int{sensu.CheckStateOK, sensu.CheckStateUnknown, sensu.CheckStateUnknown}
+	if len(summary.Dags) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(summary.Dags))
+	}
+	for i, h := range summary.Dags {
+		if h.Status != expected[i] {
+			t.Errorf("%s: expected %d, got %d (%v)", h.DagId, expected[i], h.Status, h.Error)
+		}
+	}
+}
+
+func TestPrintTextPerfdata(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/ok":             `{"dag_id": "ok"}`,
+		"/api/v1/dags/ok/dagRuns":     `{"dag_runs": [{"dag_id": "ok", "dag_run_id": "run1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/paused":         `{"dag_id": "paused", "is_paused": true}`,
+		"/api/v1/dags/failed":         `{"dag_id": "failed"}`,
+		"/api/v1/dags/failed/dagRuns": `{"dag_runs": [{"dag_id": "failed", "dag_run_id": "run1", "state": "failed"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"ok", "paused", "failed"}
+	plugin.Perfdata = true
+
+	var output bytes.Buffer
+	status, err := printText(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected critical, got %d", status)
+	}
+
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	expected := " | oks=1 warnings=0 criticals=1 unknowns=0 paused=1 dags_checked=3"
+	if !strings.HasSuffix(lines[0], expected) || strings.HasPrefix(lines[0], " |") {
+		t.Errorf("expected the perfdata on the first line of output, got %q", lines[0])
+	}
+	if strings.Count(output.String(), "|") != 1 {
+		t.Errorf("expected a single perfdata separator, got %q", output.String())
+	}
+
+	// the heartbeat closes the output, after the line carrying the perfdata
+	plugin.Heartbeat = true
+	output.Reset()
+	if _, err := printText(&output); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	if !strings.HasSuffix(lines[0], expected) || strings.Count(output.String(), "|") != 1 {
+		t.Errorf("expected the perfdata on the first line of output, got %q", output.String())
+	}
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "airflow-dag-check heartbeat ok at ") || strings.Contains(last, "|") {
+		t.Errorf("expected the heartbeat without perfdata on the last line, got %q", last)
+	}
+}
+
+func TestPrintTextQuietOk(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		t.Run(fmt.Sprint(quiet), func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags":            `{"dags": [{"dag_id": "ok"}], "total_entries": 1}`,
+				"/api/v1/dags/ok":         `{"dag_id": "ok"}`,
+				"/api/v1/dags/ok/dagRuns": `{"dag_runs": [{"dag_id": "ok", "dag_run_id": "run1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.QuietOk = quiet
+
+			var output bytes.Buffer
+			status, err := printText(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != sensu.CheckStateOK {
+				t.Errorf("expected ok, got %d", status)
+			}
+
+			expected := "All health checks returning OK for loaded DAGs\n"
+			if quiet {
+				expected = ""
+			}
+			if output.String() != expected {
+				t.Errorf("expected %q, got %q", expected, output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthTextfile(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/report":         `{"dag_id": "report"}`,
+		"/api/v1/dags/report/dagRuns": `{"dag_runs": [{"dag_run_id": "r2", "state": "failed"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"etl", "report"}
+	plugin.TextfilePath = filepath.Join(t.TempDir(), "airflow.prom")
+
+	status, _, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected critical, got %d", status)
+	}
+
+	body, err := os.ReadFile(plugin.TextfilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP airflow_dag_up Whether the DAG is healthy.
+# TYPE airflow_dag_up gauge
+airflow_dag_up{dag_id="etl"} 1
+airflow_dag_up{dag_id="report"} 0
+# HELP airflow_dags Number of DAGs checked per state.
+# TYPE airflow_dags gauge
+airflow_dags{state="ok"} 1
+airflow_dags{state="warning"} 0
+airflow_dags{state="critical"} 1
+airflow_dags{state="unknown"} 0
+airflow_dags{state="paused"} 0
+`
+	if string(body) != expected {
+		t.Errorf("unexpected textfile:\n%s", body)
+	}
+
+	plugin.TextfilePath = filepath.Join(t.TempDir(), "missing", "airflow.prom")
+	var output bytes.Buffer
+	status, _, err = checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected the status to be unaffected, got %d", status)
+	}
+	if !strings.Contains(output.String(), "Failed to write textfile:") {
+		t.Errorf("expected the failed write to be reported, got %q", output.String())
+	}
+}
+
+func TestPrintJSON(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/ok":             `{"dag_id": "ok"}`,
+		"/api/v1/dags/ok/dagRuns":     `{"dag_runs": [{"dag_id": "ok", "dag_run_id": "run1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/failed":         `{"dag_id": "failed"}`,
+		"/api/v1/dags/failed/dagRuns": `{"dag_runs": [{"dag_id": "failed", "dag_run_id": "run1", "state": "failed"}], "total_entries": 1}`,
+		"/api/v1/health":              `{"metadatabase": {"status": "healthy"}, "scheduler": {"status": "unhealthy"}}`,
+	}))
+	plugin.Dags = []string{"ok", "failed"}
+	plugin.CheckHealth = true
+	plugin.Heartbeat = true
+
+	var output bytes.Buffer
+	status, err := printJSON(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected critical, got %d", status)
+	}
+
+	var result struct {
+		Status string `json:"status"`
+		Output string `json:"output"`
+		Dags   []struct {
+			DagId  string `json:"dag_id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"dags"`
+		Findings []struct {
+			Dimension string `json:"dimension"`
+			Status    string `json:"status"`
+			Message   string `json:"message"`
+		} `json:"findings"`
+		Heartbeat string `json:"heartbeat"`
+	}
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", output.String(), err)
+	}
+
+	if result.Status != "critical" || !strings.HasPrefix(result.Output, "health CRITICAL\nAirflow components are not healthy: scheduler\n") {
+		t.Errorf("unexpected state or output: %s %q", result.Status, result.Output)
+	}
+	if len(result.Dags) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(result.Dags))
+	}
+	if result.Dags[0].DagId != "ok" || result.Dags[0].Status != "ok" || result.Dags[0].Error != "" {
+		t.Errorf("unexpected result: %+v", result.Dags[0])
+	}
+	if result.Dags[1].DagId != "failed" || result.Dags[1].Status != "critical" || result.Dags[1].Error != "DAG failed its last execution: failed run run1" {
+		t.Errorf("unexpected result: %+v", result.Dags[1])
+	}
+	if len(result.Findings) != 1 || result.Findings[0].Dimension != "health" || result.Findings[0].Status != "critical" {
+		t.Errorf("unexpected findings: %+v", result.Findings)
+	}
+	if !strings.HasPrefix(result.Heartbeat, "airflow-dag-check heartbeat ok at ") {
+		t.Errorf("unexpected heartbeat: %q", result.Heartbeat)
+	}
+}
+
+func TestPrintJSONNoDags(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags": `{"dags": [], "total_entries": 0}`,
+	}))
+
+	var output bytes.Buffer
+	status, err := printJSON(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected a warning, got %d", status)
+	}
+	if output.String() != `{"status":"warning","output":"No DAGs loaded\n","dags":[],"findings":[]}`+"\n" {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestCheckDagHealthVerbose(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_id": "etl", "dag_run_id": "run1", "state": "success"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"etl"}
+
+	for _, verbose := range []bool{false, true} {
+		plugin.Verbose = verbose
+
+		var output bytes.Buffer
+		if _, _, err := checkDagHealth(&output); err != nil {
+			t.Fatal(err)
+		}
+		if printed := strings.Contains(output.String(), "etl OK\n"); printed != verbose {
+			t.Errorf("verbose %v: unexpected output %q", verbose, output.String())
+		}
+	}
+}
+
+func TestCheckDagHealthNoDags(t *testing.T) {
+	tests := []struct {
+		status   string
+		expected int
+	}{
+		{"ok", sensu.CheckStateOK},
+		{"warning", sensu.CheckStateWarning},
+		{"critical", sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags": `{"dags": [], "total_entries": 0}`,
+			}))
+			plugin.NoDagsStatus = tt.status
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected || output.String() != "No DAGs loaded\n" {
+				t.Errorf("expected %d, got %d with %q", tt.expected, status, output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthAllUnknown(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    string
+		reportOk bool
+		expected int
+		message  bool
+	}{
+		{"default state", "critical", false, sensu.CheckStateCritical, true},
+		{"configured state", "warning", false, sensu.CheckStateWarning, true},
+		{"some DAG determined", "warning", true, sensu.CheckStateCritical, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/dags/etl", "/api/v1/dags/report":
+					fmt.Fprintf(w, `{"dag_id": "%s"}`, strings.TrimPrefix(r.URL.Path, "/api/v1/dags/"))
+				case "/api/v1/dags/report/dagRuns":
+					if tt.reportOk {
+						fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`)
+						return
+					}
+					w.WriteHeader(http.StatusInternalServerError)
+				default:
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			plugin.Dags = []string{"etl", "report"}
+			plugin.AllUnknownState = tt.state
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected {
+				t.Errorf("expected %d, got %d: %q", tt.expected, status, output.String())
+			}
+			if strings.Contains(output.String(), "Unable to determine health for any DAG\n") != tt.message {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthInstanceOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduler string
+		dagRegex  []string
+		expected  int
+		output    string
+	}{
+		{"healthy instance", "healthy", nil, sensu.CheckStateOK, "All instance health checks returning OK\n"},
+		{"unhealthy instance", "unhealthy", nil, sensu.CheckStateCritical, "health CRITICAL\nAirflow components are not healthy: scheduler\n"},
+		{"DAGs selected", "healthy", []string{"^etl_"}, sensu.CheckStateWarning, "No DAGs matched\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags":   `{"dags": [], "total_entries": 0}`,
+				"/api/v1/health": fmt.Sprintf(`{"metadatabase": {"status": "healthy"}, "scheduler": {"status": "%s"}}`, tt.scheduler),
+			}))
+			plugin.CheckHealth = true
+			plugin.DagRegex = tt.dagRegex
+			var err error
+			if plugin.dagPatterns, err = compilePatterns(tt.dagRegex); err != nil {
+				t.Fatal(err)
+			}
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected || output.String() != tt.output {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.output, status, output.String())
+			}
+		})
+	}
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+
+	plugin.Proxy = "not a proxy"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected a warning for an invalid proxy, got %d %v", status, err)
+	}
+
+	plugin.Proxy = "http://proxy.example.com:3128"
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "https://airflow.example.com/api/v1/dags", nil)
+	proxy, err := newTransport(plugin).Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy == nil || proxy.String() != plugin.Proxy {
+		t.Errorf("expected the request to go through %s, got %v", plugin.Proxy, proxy)
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	var authorization map[string]string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization["other"] = r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"dag_id": "elsewhere"}`)
+	}))
+	defer other.Close()
+
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			http.Redirect(w, r, "/api/v1/dags/moved", http.StatusFound)
+		case "/api/v1/dags/elsewhere":
+			http.Redirect(w, r, other.URL+"/api/v1/dags/elsewhere", http.StatusFound)
+		case "/api/v1/dags/moved":
+			authorization["moved"] = r.Header.Get("Authorization")
+			fmt.Fprint(w, `{"dag_id": "moved"}`)
+		}
+	}))
+	newClient := func() *apiClient {
+		return testAPI(&http.Client{CheckRedirect: redirectPolicy(plugin.FollowRedirects, newCredentials(plugin))})
+	}
+
+	authorization = map[string]string{}
+	if _, err := newClient().getDag(context.Background(), "etl"); err == nil || !strings.Contains(err.Error(), "use --follow-redirects") {
+		t.Errorf("expected the redirect to be rejected, got %v", err)
+	}
+	if _, ok := authorization["moved"]; ok {
+		t.Error("expected the redirect not to be followed")
+	}
+
+	plugin.FollowRedirects = true
+	api := newClient()
+	dag, err := api.getDag(context.Background(), "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dag.DagId != "moved" || authorization["moved"] == "" {
+		t.Errorf("expected the redirect to be followed with the credentials, got %s %q", dag.DagId, authorization["moved"])
+	}
+
+	if _, err := api.getDag(context.Background(), "elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if authorization["other"] != "" {
+		t.Errorf("expected the credentials not to be sent to another host, got %q", authorization["other"])
+	}
+}
+
+func TestVerifyEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		routes   map[string]string
+		expected bool
+	}{
+		{"airflow", map[string]string{"/api/v1/version": `{"version": "2.7.3", "git_version": ".release:2.7.3"}`}, true},
+		{"other JSON API", map[string]string{"/api/v1/version": `{"name": "grafana"}`}, false},
+		{"no version endpoint", map[string]string{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(tt.routes))
+
+			var output bytes.Buffer
+			if verified := verifyEndpoint(context.Background(), &output, testAPI(http.DefaultClient)); verified != tt.expected {
+				t.Errorf("expected %t, got %t: %q", tt.expected, verified, output.String())
+			}
+			if !tt.expected && !strings.HasPrefix(output.String(), "Endpoint does not look like an Airflow REST API: ") {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthVerifyEndpoint(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/version":          `{"name": "grafana"}`,
+		"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"etl"}
+	plugin.VerifyEndpoint = true
+
+	// the version request is charged to the budget of the check
+	budget := newRequestBudget(10)
+	var output bytes.Buffer
+	status, _, err := checkDagHealthWithin(&output, plugin, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical || !strings.HasPrefix(output.String(), "Endpoint does not look like an Airflow REST API: ") {
+		t.Errorf("expected the endpoint to be rejected, got %d: %q", status, output.String())
+	}
+	if budget.used != 1 {
+		t.Errorf("expected the version request to be charged to the budget, got %d", budget.used)
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	if _, err := parseHeaders([]string{"X-API-Key"}); err == nil {
+		t.Error("expected an error for a header without a colon")
+	}
+
+	headers, err := parseHeaders([]string{"X-API-Key: secret", "CF-Access-Client-Id: client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]bool{}
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" || r.Header.Get("CF-Access-Client-Id") != "client" {
+			t.Errorf("missing headers on %s: %v", r.URL.Path, r.Header)
+		}
+		requests[r.URL.Path] = true
+
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`)
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			fmt.Fprint(w, `{"dag_runs": [], "total_entries": 0}`)
+		}
+	}))
+	plugin.customHeaders = headers
+
+	if _, _, err := checkDagHealth(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/api/v1/dags", "/api/v1/dags/etl", "/api/v1/dags/etl/dagRuns"} {
+		if !requests[p] {
+			t.Errorf("expected a request to %s", p)
+		}
+	}
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	requests := 0
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"title": "Too Many Requests"}`)
+			return
+		}
+		fmt.Fprint(w, `{"dag_id": "etl"}`)
+	}))
+
+	api := testAPI(&http.Client{Transport: &retryTransport{transport: http.DefaultTransport}})
+
+	start := time.Now()
+	dag, err := api.getDag(context.Background(), "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dag.DagId != "etl" || requests != 2 {
+		t.Errorf("expected the DAG after a retry, got %+v after %d requests", dag, requests)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the retry to wait for Retry-After, waited %s", elapsed)
+	}
+}
+
+func TestDoAPIRequest(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprintf(w, `{"dag_id": "etl", "is_paused": %v}`, r.URL.Query().Get("paused"))
+		case "/api/v1/dags/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/v1/dags/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/api/v1/dags/empty":
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body>502 Bad Gateway</body></html>`)
+		}
+	}))
+
+	var dag Dag
+	if err := testAPI(http.DefaultClient).get(context.Background(), "/dags/etl", url.Values{"paused": {"true"}}, &dag); err != nil {
+		t.Fatal(err)
+	}
+	if dag.DagId != "etl" || !dag.IsPaused {
+		t.Errorf("unexpected decoded DAG: %+v", dag)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		status  int
+		message string
+	}{
+		{"client error", "/dags/missing", http.StatusNotFound, ""},
+		{"server error", "/dags/broken", http.StatusInternalServerError, ""},
+		{"empty body", "/dags/empty", 0, "GET /dags/empty returned an empty response: 200 OK"},
+		{"html error page", "/dags", 0, "GET /dags returned a response that is not JSON: 200 OK, Content-Type \"text/html\": <html><body>502 Bad Gateway</body></html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testAPI(http.DefaultClient).get(context.Background(), tt.path, nil, &dag)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.status != 0 && !isStatus(err, tt.status) {
+				t.Errorf("expected status %d in the error, got %v", tt.status, err)
+			}
+			if tt.message != "" && err.Error() != tt.message {
+				t.Errorf("expected %q, got %q", tt.message, err.Error())
+			}
+		})
+	}
+}
+
+func TestPrintInstances(t *testing.T) {
+	healthy := useServer(t, routes(map[string]string{
+		"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+		"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+	}))
+	var username string
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ = r.BasicAuth()
+		routes(map[string]string{
+			"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+			"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+			"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+		}).ServeHTTP(w, r)
+	}))
+	defer failing.Close()
+
+	plugin.AirflowApiUrls = []string{healthy.URL, failing.URL}
+	plugin.AirflowUsernames = []string{"admin", "eu-admin"}
+	plugin.AirflowPasswords = []string{"admin", "secret"}
+
+	var output bytes.Buffer
+	status, err := printInstances(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected the worst state of the instances, got %d", status)
+	}
+	if username != "eu-admin" {
+		t.Errorf("expected the credentials of the instance, got %q", username)
+	}
+	if plugin.AirflowApiUrl != healthy.URL {
+		t.Errorf("expected the configuration to be restored, got %s", plugin.AirflowApiUrl)
+	}
+
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	healthyHost := strings.TrimPrefix(healthy.URL, "http://")
+	failingHost := strings.TrimPrefix(failing.URL, "http://")
+	if lines[0] != healthyHost+": All health checks returning OK for loaded DAGs" {
+		t.Errorf("unexpected output of the healthy instance: %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, failingHost+": ") {
+			t.Errorf("expected the failing instance host as prefix: %q", line)
+		}
+	}
+	if !strings.Contains(output.String(), "DAG failed its last execution: etl") {
+		t.Errorf("expected the failed DAG in the output: %q", output.String())
+	}
+}
+
+func TestDebug(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.Debug = enabled
+
+			var debug bytes.Buffer
+			stderr = &debug
+			defer func() { stderr = os.Stderr }()
+
+			var output bytes.Buffer
+			if _, _, err := checkDagHealth(&output); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(output.String(), "debug:") {
+				t.Errorf("expected no debug lines in the check output: %q", output.String())
+			}
+
+			if !enabled {
+				if debug.Len() > 0 {
+					t.Errorf("expected no debug output, got %q", debug.String())
+				}
+				return
+			}
+			for _, line := range []string{
+				"debug: GET " + plugin.AirflowApiUrl + "/api/v1/dags/etl -> 200 OK\n",
+				"debug: dag etl latest run state=success -> OK\n",
+			} {
+				if !strings.Contains(debug.String(), line) {
+					t.Errorf("expected %q in the debug output: %q", line, debug.String())
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthPaused(t *testing.T) {
+	tests := []struct {
+		name        string
+		pausedState string
+		expected    int
+	}{
+		{"default state", "warning", sensu.CheckStateWarning},
+		{"configured state", "critical", sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/paused":        `{"dag_id": "paused", "is_paused": true}`,
+				"/api/v1/dags/stale":         `{"dag_id": "stale"}`,
+				"/api/v1/dags/stale/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success", "end_date": "2020-01-01T00:00:00Z"}], "total_entries": 1}`,
+			}))
+			plugin.Dags = []string{"paused", "stale"}
+			plugin.MaxAge = 3600
+			plugin.PausedState = tt.pausedState
+
+			var output bytes.Buffer
+			status, summary, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected {
+				t.Errorf("expected %d, got %d: %q", tt.expected, status, output.String())
+			}
+			if summary.Paused != 1 || summary.Warnings != 1 {
+				t.Errorf("expected the paused DAG to be counted apart from the warning, got %+v", summary)
+			}
+			if !strings.Contains(output.String(), "paused PAUSED\n") || !strings.Contains(output.String(), "stale WARNING\n") {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthSummaryOnly(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/ok":             `{"dag_id": "ok"}`,
+		"/api/v1/dags/ok/dagRuns":     `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/paused":         `{"dag_id": "paused", "is_paused": true}`,
+		"/api/v1/dags/failed":         `{"dag_id": "failed"}`,
+		"/api/v1/dags/failed/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"ok", "paused", "failed"}
+	plugin.SummaryOnly = true
+
+	var output bytes.Buffer
+	status, _, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected the status to be unchanged, got %d", status)
+	}
+	if output.String() != "1 of 2 DAGs unhealthy: 1 OK, 0 WARNING, 1 CRITICAL, 0 UNKNOWN, 1 PAUSED\n" {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestCheckDagHealthListDags(t *testing.T) {
+	var requested []string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl_daily"}, {"dag_id": "etl_test"}, {"dag_id": "report"}], "total_entries": 3}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.ListDags = true
+
+	var err error
+	if plugin.dagPatterns, err = compilePatterns([]string{"^etl_"}); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.excludePatterns, err = compilePatterns([]string{"_test$"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	status, _, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateOK || output.String() != "etl_daily\n" {
+		t.Errorf("expected the filtered DAGs to be listed, got %d %q", status, output.String())
+	}
+	for _, path := range requested {
+		if path != "/api/v1/dags" {
+			t.Errorf("expected only the DAGs to be listed, got a request to %s", path)
+		}
+	}
+}
+
+func TestCheckDagHealthDuplicateDags(t *testing.T) {
+	requests := map[string]int{}
+	handler := routes(map[string]string{
+		"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [], "total_entries": 0}`,
+		"/api/v1/dags/report":         `{"dag_id": "report"}`,
+		"/api/v1/dags/report/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+	})
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		handler.ServeHTTP(w, r)
+	}))
+	plugin.Dags = []string{"etl", "report", "etl"}
+
+	_, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Dags) != 2 {
+		t.Errorf("expected each DAG to be checked once, got %+v", summary.Dags)
+	}
+	for _, path := range []string{"/api/v1/dags/etl", "/api/v1/dags/etl/dagRuns", "/api/v1/dags/report"} {
+		if requests[path] != 1 {
+			t.Errorf("expected %s to be requested once, got %d", path, requests[path])
+		}
+	}
+}
+
+func TestGetDagCache(t *testing.T) {
+	requests := 0
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"dag_id": "etl"}`)
+	}))
+	api := testAPI(http.DefaultClient)
+	api.dags = map[string]*Dag{}
+
+	for i := 0; i < 2; i++ {
+		if _, err := api.getDag(context.Background(), "etl"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the DAG to be retrieved once, got %d requests", requests)
+	}
+}
+
+func TestCheckDagHealthMinDagCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		minCount int
+		expected int
+	}{
+		{"meets the minimum", 2, sensu.CheckStateOK},
+		{"falls short", 3, sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags":                `{"dags": [{"dag_id": "etl"}, {"dag_id": "report"}], "total_entries": 2}`,
+				"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [], "total_entries": 0}`,
+				"/api/v1/dags/report":         `{"dag_id": "report"}`,
+				"/api/v1/dags/report/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+			}))
+			plugin.MinDagCount = tt.minCount
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected {
+				t.Errorf("expected %d, got %d: %q", tt.expected, status, output.String())
+			}
+			if tt.expected != sensu.CheckStateOK && !strings.Contains(output.String(), "Only 2 DAGs to check, expected at least 3") {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthMaxDags(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDags  int
+		checked  int
+		expected int
+	}{
+		{"under the cap", 3, 2, sensu.CheckStateOK},
+		{"over the cap", 1, 1, sensu.CheckStateWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags":                `{"dags": [{"dag_id": "etl"}, {"dag_id": "report"}], "total_entries": 2}`,
+				"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [], "total_entries": 0}`,
+				"/api/v1/dags/report":         `{"dag_id": "report"}`,
+				"/api/v1/dags/report/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+			}))
+			plugin.MaxDags = tt.maxDags
+
+			var output bytes.Buffer
+			status, summary, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected || len(summary.Dags) != tt.checked {
+				t.Errorf("expected %d with %d DAGs checked, got %d with %d: %q", tt.expected, tt.checked, status, len(summary.Dags), output.String())
+			}
+			truncated := strings.Contains(output.String(), "Checking only the first 1 of 2 discovered DAGs")
+			if truncated != (tt.expected == sensu.CheckStateWarning) {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthPercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		failed   int
+		expected int
+	}{
+		{"below the threshold", 1, sensu.CheckStateOK},
+		{"above the warning threshold", 2, sensu.CheckStateWarning},
+		{"above the critical threshold", 3, sensu.CheckStateCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{}
+			var listed []string
+			for i := 0; i < 10; i++ {
+				dagId := fmt.Sprintf("etl_%d", i)
+				runState := "success"
+				if i < tt.failed {
+					runState = "failed"
+				}
+				listed = append(listed, fmt.Sprintf(`{"dag_id": "%s"}`, dagId))
+				responses["/api/v1/dags/"+dagId] = fmt.Sprintf(`{"dag_id": "%s"}`, dagId)
+				responses["/api/v1/dags/"+dagId+"/dagRuns"] = fmt.Sprintf(`{"dag_runs": [{"dag_run_id": "r1", "state": "%s"}], "total_entries": 1}`, runState)
+			}
+			responses["/api/v1/dags"] = fmt.Sprintf(`{"dags": [%s], "total_entries": 10}`, strings.Join(listed, ", "))
+			useServer(t, routes(responses))
+			plugin.WarningPercent = 10
+			plugin.CriticalPercent = 20
+
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.expected {
+				t.Errorf("expected %d, got %d: %q", tt.expected, status, output.String())
+			}
+			if !strings.Contains(output.String(), fmt.Sprintf("%d.0%% of DAGs unhealthy\n", tt.failed*10)) {
+				t.Errorf("unexpected output: %q", output.String())
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthAlertNewFailures(t *testing.T) {
+	runId := "r1"
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags":
+			fmt.Fprint(w, `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`)
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl"}`)
+		case "/api/v1/dags/etl/dagRuns":
+			fmt.Fprintf(w, `{"dag_runs": [{"dag_run_id": "%s", "state": "failed"}], "total_entries": 1}`, runId)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.Dags = []string{"etl"}
+	plugin.AlertNewFailures = true
+	plugin.StateFile = filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(plugin.StateFile, []byte("{corrupt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		runId    string
+		expected int
+	}{
+		{"first run", "r1", sensu.CheckStateCritical},
+		{"repeated failure", "r1", sensu.CheckStateWarning},
+		{"new failure", "r2", sensu.CheckStateCritical},
+	}
+
+	for _, step := range steps {
+		runId = step.runId
+		status, _, err := checkDagHealth(io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != step.expected {
+			t.Errorf("%s: expected %d, got %d", step.name, step.expected, status)
+		}
+	}
+}
+
+func TestCheckDagHealthFailFast(t *testing.T) {
+	requested := map[string]bool{}
+	handler := routes(map[string]string{
+		"/api/v1/dags/ok":             `{"dag_id": "ok"}`,
+		"/api/v1/dags/ok/dagRuns":     `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/failed":         `{"dag_id": "failed"}`,
+		"/api/v1/dags/failed/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+		"/api/v1/dags/later":          `{"dag_id": "later"}`,
+		"/api/v1/dags/later/dagRuns":  `{"dag_runs": [], "total_entries": 0}`,
+	})
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested[r.URL.Path] = true
+		handler.ServeHTTP(w, r)
+	}))
+	plugin.Dags = []string{"ok", "failed", "later"}
+	plugin.FailFast = true
+
+	status, summary, err := checkDagHealth(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateCritical || len(summary.Dags) != 2 || summary.Dags[1].DagId != "failed" {
+		t.Errorf("expected to stop at the failed DAG, got %d %+v", status, summary.Dags)
+	}
+	if requested["/api/v1/dags/later"] {
+		t.Error("expected the DAG after the critical one not to be requested")
+	}
+}
+
+func TestCheckDagHealthTimings(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.Dags = []string{"etl"}
+			plugin.Timings = enabled
+
+			var timings bytes.Buffer
+			stderr = &timings
+			defer func() { stderr = os.Stderr }()
+
+			var output bytes.Buffer
+			if _, _, err := checkDagHealth(&output); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(output.String(), "timings:") {
+				t.Errorf("expected no timings in the check output: %q", output.String())
+			}
+
+			if !enabled {
+				if timings.Len() > 0 {
+					t.Errorf("expected no timings, got %q", timings.String())
+				}
+				return
+			}
+			if !regexp.MustCompile(`(?m)^timings: total \S+$`).MatchString(timings.String()) {
+				t.Errorf("expected the total duration, got %q", timings.String())
+			}
+			if !strings.Contains(timings.String(), "timings: slowest DAG etl ") || !strings.Contains(timings.String(), " over 1 DAGs\n") {
+				t.Errorf("expected the DAG timings, got %q", timings.String())
+			}
+		})
+	}
+}
+
+func TestAcceptHeader(t *testing.T) {
+	var accept string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		fmt.Fprint(w, `{"dag_id": "etl"}`)
+	}))
+	plugin.AcceptHeader = "application/json; version=2.0"
+
+	if _, err := testAPI(http.DefaultClient).getDag(context.Background(), "etl"); err != nil {
+		t.Fatal(err)
+	}
+	if accept != "application/json; version=2.0" {
+		t.Errorf("expected the configured Accept header, got %q", accept)
+	}
+}
+
+// newTestAPIClient returns an apiClient of the server that does not read the
+// plugin configuration.
+// testAPI returns the apiClient of the current configuration, built at the
+// call so the options a test sets beforehand apply.
+func testAPI(client *http.Client) *apiClient {
+	return newAPIClient(plugin, client)
+}
+
+func newTestAPIClient(t *testing.T, handler http.Handler) *apiClient {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return &apiClient{
+		baseUrl:      server.URL + "/api/v1",
+		creds:        credentials{username: "admin", password: "admin"},
+		accept:       "application/json",
+		headers:      http.Header{"X-Tenant": {"ops"}},
+		client:       server.Client(),
+		historyLimit: 10,
+
+		okStatusCodes: []int{200},
+	}
+}
+
+func TestNewAirflowClient(t *testing.T) {
+	if _, err := newAirflowClient(Config{AirflowApiUrl: "localhost:8080"}, nil); err == nil {
+		t.Error("expected an error for a URL without scheme")
+	}
+
+	client, err := newAirflowClient(Config{AirflowApiUrl: "http://localhost:8080", Timeout: 7}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout != 7*time.Second {
+		t.Errorf("expected the timeout of the configuration, got %s", client.Timeout)
+	}
+	if _, ok := client.Transport.(*countingTransport); !ok {
+		t.Errorf("expected the requests to be counted, got %T", client.Transport)
+	}
+}
+
+func TestAPIClientGetDag(t *testing.T) {
+	api := newTestAPIClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "admin" || password != "admin" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if r.Header.Get("X-Tenant") != "ops" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/dags/etl":
+			fmt.Fprint(w, `{"dag_id": "etl", "is_paused": true}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	dag, err := api.getDag(context.Background(), "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dag.DagId != "etl" || !dag.IsPaused {
+		t.Errorf("unexpected DAG %+v", dag)
+	}
+
+	if _, err := api.getDag(context.Background(), "missing"); err != errDagNotFound {
+		t.Errorf("expected errDagNotFound, got %v", err)
+	}
+}
+
+func TestAPIClientGetAllDags(t *testing.T) {
+	api := newTestAPIClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("tags") != "etl" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var dags []string
+		switch r.URL.Query().Get("offset") {
+		case "0":
+			for i := 0; i < dagPageLimit; i++ {
+				dags = append(dags, fmt.Sprintf(`{"dag_id": "dag_%d"}`, i))
+			}
+		case fmt.Sprint(dagPageLimit):
+			dags = append(dags, `{"dag_id": "last"}`)
+		}
+		fmt.Fprintf(w, `{"dags": [%s], "total_entries": %d}`, strings.Join(dags, ","), dagPageLimit+1)
+	}))
+
+	dagList, err := api.getAllDags(context.Background(), url.Values{"tags": {"etl"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dagList.Dags) != dagPageLimit+1 || dagList.Dags[dagPageLimit].DagId != "last" {
+		t.Errorf("expected %d DAGs ending with the second page, got %d", dagPageLimit+1, len(dagList.Dags))
+	}
+}
+
+func TestAPIClientGetLatestDagRun(t *testing.T) {
+	runs := []string{
+		`{"dag_run_id": "r2", "state": "running"}`,
+		`{"dag_run_id": "r1", "state": "success"}`,
+	}
+	api := newTestAPIClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/dags/etl/dagRuns" || r.URL.Query().Get("order_by") != "-execution_date" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := offset + limit
+		if end > len(runs) {
+			end = len(runs)
+		}
+		fmt.Fprintf(w, `{"dag_runs": [%s], "total_entries": %d}`, strings.Join(runs[offset:end], ", "), len(runs))
+	}))
+
+	run, err := api.getLatestDagRun(context.Background(), "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run == nil || run.DagRunId != "r2" {
+		t.Errorf("expected the most recent run r2, got %+v", run)
+	}
+
+	api.skipActiveRuns = true
+	run, err = api.getLatestDagRun(context.Background(), "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run == nil || run.DagRunId != "r1" {
+		t.Errorf("expected the completed run r1, got %+v", run)
+	}
+
+	if run, err := api.getLatestDagRun(context.Background(), "missing"); err == nil || run != nil {
+		t.Errorf("expected an error for an unknown DAG, got %+v", run)
+	}
+}
+
+func TestDagPath(t *testing.T) {
+	tests := []struct {
+		dagId    string
+		elems    []string
+		expected string
+	}{
+		{"etl", nil, "/dags/etl"},
+		{"my dag", []string{"dagRuns"}, "/dags/my%20dag/dagRuns"},
+		{"team/etl", []string{"dagRuns", "manual__2024-01-01T00:00:00+00:00"}, "/dags/team%2Fetl/dagRuns/manual__2024-01-01T00:00:00+00:00"},
+		{"etl?x=1#y", []string{"tasks"}, "/dags/etl%3Fx=1%23y/tasks"},
+	}
+
+	for _, test := range tests {
+		if actual := dagPath(test.dagId, test.elems...); actual != test.expected {
+			t.Errorf("expected %s for %q, got %s", test.expected, test.dagId, actual)
+		}
+	}
+}
+
+func TestCheckDagEscapesDagId(t *testing.T) {
+	var paths []string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		switch r.URL.EscapedPath() {
+		case "/api/v1/dags/team%2Fmy%20etl":
+			fmt.Fprint(w, `{"dag_id": "team/my etl"}`)
+		case "/api/v1/dags/team%2Fmy%20etl/dagRuns":
+			fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	health := checkDag(context.Background(), "team/my etl", true, testAPI(http.DefaultClient))
+	if health.Status != sensu.CheckStateOK || health.DagRunId != "r1" {
+		t.Errorf("expected the escaped DAG to be checked, got %d (%v) for requests %v", health.Status, health.Error, paths)
+	}
+}
+
+func TestEscapesConnectionAndPoolIds(t *testing.T) {
+	var paths []string
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		switch r.URL.EscapedPath() {
+		case "/api/v1/connections/aws%2Fprod%20s3":
+			fmt.Fprint(w, `{"connection_id": "aws/prod s3", "conn_type": "aws"}`)
+		case "/api/v1/pools/etl%3Fx=1%23pool":
+			fmt.Fprint(w, `{"name": "etl?x=1#pool", "slots": 4, "occupied_slots": 1, "open_slots": 3}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	if finding := checkConnection(context.Background(), "aws/prod s3", testAPI(http.DefaultClient)); finding.Status != sensu.CheckStateOK {
+		t.Errorf("expected the escaped connection to be found, got %d (%s) for requests %v", finding.Status, finding.Message, paths)
+	}
+	if finding := checkPoolSlots(context.Background(), "etl?x=1#pool", testAPI(http.DefaultClient)); finding.Status != sensu.CheckStateOK {
+		t.Errorf("expected the escaped pool to be found, got %d (%s) for requests %v", finding.Status, finding.Message, paths)
+	}
+}
+
+func TestParseDagStates(t *testing.T) {
+	parsed, err := parseDagStates([]string{"sensor = success, failed", "etl=skipped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(parsed) != "map[etl:[skipped] sensor:[success failed]]" {
+		t.Errorf("unexpected states %v", parsed)
+	}
+
+	for _, invalid := range []string{"sensor", "=success", "sensor="} {
+		if _, err := parseDagStates([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCheckDagOkStatesPerDag(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/sensor":         `{"dag_id": "sensor"}`,
+		"/api/v1/dags/sensor/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+		"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [{"dag_run_id": "r1", "state": "failed"}], "total_entries": 1}`,
+	}))
+	plugin.okStatesByDag = map[string][]string{"sensor": {"success", "failed"}}
+
+	if health := checkDag(context.Background(), "sensor", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateOK {
+		t.Errorf("expected the failed sensor run to be ok, got %d (%v)", health.Status, health.Error)
+	}
+	if health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateCritical {
+		t.Errorf("expected the failed etl run to still be critical, got %d (%v)", health.Status, health.Error)
+	}
+
+	plugin.okStatesByDag = map[string][]string{"sensor": {"skipped"}}
+	if health := checkDag(context.Background(), "sensor", true, testAPI(http.DefaultClient)); health.Status != sensu.CheckStateCritical {
+		t.Errorf("expected the failed sensor run outside its ok states to be critical, got %d (%v)", health.Status, health.Error)
+	}
+}
+
+func TestCheckArgsInvalidOkStatusCodes(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+	plugin.OkStatusCodes = []int{200, 2040}
+
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "--ok-status-codes") {
+		t.Errorf("expected a warning for an invalid status code, got %d %v", status, err)
+	}
+}
+
+func TestAPIClientOkStatusCodes(t *testing.T) {
+	api := newTestAPIClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/dags/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/v1/dags/gateway":
+			w.WriteHeader(http.StatusNonAuthoritativeInfo)
+			fmt.Fprint(w, `{"dag_id": "gateway"}`)
+		default:
+			w.WriteHeader(http.StatusFound)
+		}
+	}))
+
+	var dag Dag
+	if err := api.get(context.Background(), "/dags/empty", nil, &dag); err == nil || !strings.Contains(err.Error(), "empty response") {
+		t.Errorf("expected an unlisted 204 to be an error, got %v", err)
+	}
+	if err := api.get(context.Background(), "/dags/gateway", nil, &dag); err != nil || dag.DagId != "gateway" {
+		t.Errorf("expected a 2xx response with a body to succeed, got %v", err)
+	}
+	if err := api.get(context.Background(), "/dags/moved", nil, &dag); !isStatus(err, http.StatusFound) {
+		t.Errorf("expected an unlisted 302 to be an API error, got %v", err)
+	}
+
+	api.okStatusCodes = []int{200, 204, 302}
+	dag = Dag{}
+	if err := api.get(context.Background(), "/dags/empty", nil, &dag); err != nil || dag.DagId != "" {
+		t.Errorf("expected a listed 204 to succeed without decoding, got %v", err)
+	}
+	if err := api.get(context.Background(), "/dags/moved", nil, &dag); err != nil {
+		t.Errorf("expected a listed 302 to succeed, got %v", err)
+	}
+}
+
+func TestCheckDagHealthRequestBudget(t *testing.T) {
+	requests := 0
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/api/v1/dags":
+			var dags []string
+			for i := 0; i < 10; i++ {
+				dags = append(dags, fmt.Sprintf(`{"dag_id": "dag_%d"}`, i))
+			}
+			fmt.Fprintf(w, `{"dags": [%s], "total_entries": 10}`, strings.Join(dags, ","))
+		case strings.HasSuffix(r.URL.Path, "/dagRuns"):
+			fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`)
+		case strings.HasPrefix(r.URL.Path, "/api/v1/dags/"):
+			fmt.Fprintf(w, `{"dag_id": "%s"}`, strings.TrimPrefix(r.URL.Path, "/api/v1/dags/"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	plugin.MaxTotalRequests = 8
+
+	var output bytes.Buffer
+	status, summary, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests > plugin.MaxTotalRequests {
+		t.Errorf("expected at most %d requests, got %d", plugin.MaxTotalRequests, requests)
+	}
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected a warning, got %d: %q", status, output.String())
+	}
+	if summary.Oks == 0 || summary.Unknowns == 0 || summary.Oks+summary.Unknowns != 10 {
+		t.Errorf("expected the DAGs to be split between checked and unknown, got %+v", summary)
+	}
+	if !strings.Contains(output.String(), "request budget exceeded before checking this DAG: dag_9") ||
+		!strings.Contains(output.String(), "Request budget of 8 exceeded") {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestCheckDagHealthRequestBudgetDiscovery(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags": `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+	}))
+	plugin.MaxTotalRequests = 1
+
+	// the credentials probe spends the budget before the DAGs are listed
+	var output bytes.Buffer
+	status, _, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateWarning || output.String() != "Request budget of 1 exceeded before the DAGs were discovered\n" {
+		t.Errorf("expected a warning, got %d: %q", status, output.String())
+	}
+}
+
+func TestCheckDagHealthRequestBudgetFindings(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+		"/api/v1/health":           `{"metadatabase": {"status": "healthy"}, "scheduler": {"status": "healthy"}}`,
+		"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"etl"}
+	plugin.CheckHealth = true
+	plugin.MaxTotalRequests = 1
+
+	var output bytes.Buffer
+	status, _, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected a warning, got %d: %q", status, output.String())
+	}
+	if !strings.HasPrefix(output.String(), "health WARNING\ncould not retrieve airflow health: ") ||
+		!strings.Contains(output.String(), "request budget exceeded before checking this DAG: etl") {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestRequestBudgetRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client, err := newAirflowClient(Config{AirflowApiUrl: server.URL, Retries: 5}, newRequestBudget(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, errRequestBudget) {
+		t.Errorf("expected the retries to exhaust the budget, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestPrintInstancesRequestBudget(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		routes(map[string]string{
+			"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+			"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+			"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		}).ServeHTTP(w, r)
+	})
+	first := useServer(t, handler)
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	plugin.AirflowApiUrls = []string{first.URL, second.URL}
+	plugin.MaxTotalRequests = 5
+
+	var output bytes.Buffer
+	status, err := printInstances(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests > plugin.MaxTotalRequests {
+		t.Errorf("expected at most %d requests across the instances, got %d", plugin.MaxTotalRequests, requests)
+	}
+	expected := strings.TrimPrefix(second.URL, "http://") + ": Request budget of 5 exceeded before the DAGs were discovered"
+	if status != sensu.CheckStateWarning || !strings.Contains(output.String(), expected) {
+		t.Errorf("expected the budget to cover both instances, got %d: %q", status, output.String())
+	}
+}
+
+func TestPrintTextSummaryLine(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":    fmt.Sprintf(`{"dag_runs": [{"dag_run_id": "r1", "state": "success", "end_date": "%s"}], "total_entries": 1}`, time.Now().UTC().Format(time.RFC3339)),
+		"/api/v1/dags/report":         `{"dag_id": "report"}`,
+		"/api/v1/dags/report/dagRuns": `{"dag_runs": [{"dag_run_id": "r2", "state": "failed"}], "total_entries": 1}`,
+		"/api/v1/dags/stale":          `{"dag_id": "stale"}`,
+		"/api/v1/dags/stale/dagRuns":  `{"dag_runs": [{"dag_run_id": "r3", "state": "success", "end_date": "2020-01-01T00:00:00Z"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"etl", "report", "stale", "missing"}
+	plugin.MaxAge = 3600
+	plugin.NotFoundState = "unknown"
+	plugin.SummaryOnly = true
+	plugin.SummaryLine = true
+
+	var output bytes.Buffer
+	status, err := printText(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if fields[0] != summaryLinePrefix {
+		t.Fatalf("expected the output to end with the summary line, got %q", output.String())
+	}
+	values := map[string]string{}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		values[parts[0]] = parts[1]
+	}
+	expected := map[string]string{"state": strings.ToLower(stateName(status)), "dags": "4", "ok": "1", "warn": "1", "crit": "1", "unknown": "1", "paused": "0"}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("expected %s=%s, got %q", key, value, lines[len(lines)-1])
+		}
+	}
+
+	// the line survives --quiet-ok, which drops the rest of an OK output
+	plugin.Dags = []string{"etl"}
+	plugin.QuietOk = true
+	output.Reset()
+	if _, err := printText(&output); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != summaryLinePrefix+" state=ok dags=1 ok=1 warn=0 crit=0 unknown=0 paused=0\n" {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+
+	// and so does the heartbeat, ahead of the summary line
+	plugin.Heartbeat = true
+	output.Reset()
+	if _, err := printText(&output); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "airflow-dag-check heartbeat ok at ") || !strings.HasPrefix(lines[1], summaryLinePrefix+" state=ok") {
+		t.Errorf("expected the heartbeat to survive --quiet-ok, got %q", output.String())
+	}
+}
+
+func TestCheckArgsWaitTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitTimeout int
+		timeout     int
+	}{
+		{"within the timeout", 10, 15},
+		{"default wait timeout", 300, 15},
+		{"unbounded check", 300, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := plugin
+			defer func() { plugin = saved }()
+
+			plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+			plugin.ApiVersion = "v1"
+			plugin.AcceptHeader = "application/json"
+			plugin.AirflowUsername = "admin"
+			plugin.AirflowPassword = "admin"
+			plugin.HistoryLimit = 10
+			plugin.FailureThreshold = 1
+			plugin.WaitCompletion = true
+			plugin.PollInterval = 10
+			plugin.WaitTimeout = tt.waitTimeout
+			plugin.Timeout = tt.timeout
+
+			if _, err := checkArgs(nil); err != nil {
+				t.Errorf("expected the wait timeout to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWaitForDagRunDeadline(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitTimeout int
+		deadline    time.Duration
+	}{
+		{"deadline of the check", 300, 500 * time.Millisecond},
+		{"interval longer than the wait timeout", 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls := 0
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				polls++
+				fmt.Fprint(w, `{"dag_runs": [{"dag_run_id": "r1", "state": "running"}], "total_entries": 1}`)
+			}))
+			plugin.WaitTimeout = tt.waitTimeout
+			plugin.PollInterval = 10
+
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+
+			_, err := waitForDagRun(ctx, "etl", testAPI(http.DefaultClient))
+			if err != errWaitTimeout {
+				t.Errorf("expected the wait to time out, got %v", err)
+			}
+			if polls != 1 {
+				t.Errorf("expected a single poll before the wait ends, got %d", polls)
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthPercentPaused(t *testing.T) {
+	useServer(t, routes(map[string]string{
+		"/api/v1/dags/paused":     `{"dag_id": "paused", "is_paused": true}`,
+		"/api/v1/dags/ok":         `{"dag_id": "ok"}`,
+		"/api/v1/dags/ok/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+	}))
+	plugin.Dags = []string{"paused", "ok"}
+	plugin.CriticalPercent = 10
+	plugin.TrendFile = filepath.Join(t.TempDir(), "trend")
+
+	var output bytes.Buffer
+	status, summary, err := checkDagHealth(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the paused DAG is left out of the share, only --paused-state applies
+	if status != sensu.CheckStateWarning || summary.Paused != 1 {
+		t.Errorf("expected the paused state, got %d: %q", status, output.String())
+	}
+	if !strings.Contains(output.String(), "0.0% of DAGs unhealthy\n") {
+		t.Errorf("expected the paused DAG not to count as unhealthy: %q", output.String())
+	}
+
+	trend, err := os.ReadFile(plugin.TrendFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(trend), " 100\n") {
+		t.Errorf("expected a healthy share of 100%%, got %q", trend)
+	}
+}
+
+func TestPrintInstancesSummaryLine(t *testing.T) {
+	healthy := useServer(t, routes(map[string]string{
+		"/api/v1/dags":             `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+		"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+	}))
+	failing := httptest.NewServer(routes(map[string]string{
+		"/api/v1/dags":                `{"dags": [{"dag_id": "etl"}, {"dag_id": "report"}], "total_entries": 2}`,
+		"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+		"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		"/api/v1/dags/report":         `{"dag_id": "report"}`,
+		"/api/v1/dags/report/dagRuns": `{"dag_runs": [{"dag_run_id": "r2", "state": "failed"}], "total_entries": 1}`,
+	}))
+	defer failing.Close()
+
+	plugin.AirflowApiUrls = []string{healthy.URL, failing.URL}
+	plugin.SummaryLine = true
+	plugin.QuietOk = true
+
+	var output bytes.Buffer
+	if _, err := printInstances(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	// the quiet healthy instance prints nothing, the summary line covers both
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	summaryLines := 0
+	for _, line := range lines {
+		if strings.Contains(line, summaryLinePrefix) {
+			summaryLines++
+		}
+		if strings.HasPrefix(line, strings.TrimPrefix(healthy.URL, "http://")) {
+			t.Errorf("expected no output for the quiet healthy instance: %q", line)
+		}
+	}
+	expected := summaryLinePrefix + " state=critical dags=3 ok=2 warn=0 crit=1 unknown=0 paused=0"
+	if summaryLines != 1 || lines[len(lines)-1] != expected {
+		t.Errorf("expected a single unprefixed summary line %q, got %q", expected, output.String())
+	}
+}
+
+func TestCheckDagHealthGraphql(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		rest     []string
+	}{
+		{"both DAGs returned", http.StatusOK, `{"data": {"dags": [
+			{"dag_id": "etl", "latest_dag_run": {"dag_run_id": "r1", "state": "success"}},
+			{"dag_id": "report", "latest_dag_run": {"dag_run_id": "r2", "state": "failed"}}
+		]}}`, nil},
+		{"DAG left out", http.StatusOK, `{"data": {"dags": [
+			{"dag_id": "etl", "latest_dag_run": {"dag_run_id": "r1", "state": "success"}}
+		]}}`, []string{"/api/v1/dags/report", "/api/v1/dags/report/dagRuns"}},
+		{"query errors", http.StatusOK, `{"data": null, "errors": [{"message": "Cannot query field \"dags\""}]}`,
+			[]string{"/api/v1/dags/etl", "/api/v1/dags/etl/dagRuns", "/api/v1/dags/report", "/api/v1/dags/report/dagRuns"}},
+		{"endpoint failing", http.StatusBadGateway, ``,
+			[]string{"/api/v1/dags/etl", "/api/v1/dags/etl/dagRuns", "/api/v1/dags/report", "/api/v1/dags/report/dagRuns"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rest []string
+			var query graphqlRequest
+			server := useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/graphql" {
+					if r.Method != "POST" || r.Header.Get("Authorization") == "" {
+						t.Errorf("expected an authenticated POST, got %s %q", r.Method, r.Header.Get("Authorization"))
+					}
+					if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+						t.Errorf("failed to decode query: %v", err)
+					}
+					w.WriteHeader(tt.status)
+					fmt.Fprint(w, tt.response)
+					return
+				} else if r.URL.Path != "/api/v1/dags" {
+					rest = append(rest, r.URL.Path)
+				}
+				routes(map[string]string{
+					"/api/v1/dags":                `{"dags": [{"dag_id": "etl"}, {"dag_id": "report"}], "total_entries": 2}`,
+					"/api/v1/dags/etl":            `{"dag_id": "etl"}`,
+					"/api/v1/dags/etl/dagRuns":    `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+					"/api/v1/dags/report":         `{"dag_id": "report"}`,
+					"/api/v1/dags/report/dagRuns": `{"dag_runs": [{"dag_run_id": "r2", "state": "failed"}], "total_entries": 1}`,
+				}).ServeHTTP(w, r)
+			}))
+			plugin.Dags = []string{"etl", "report"}
+			plugin.GraphqlUrl = server.URL + "/graphql"
+
+			// the outcome is the same whichever API answered
+			var output bytes.Buffer
+			status, _, err := checkDagHealth(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := "report CRITICAL\nError occurred while checking DAG:\nDAG failed its last execution: report run r2\n"
+			if status != sensu.CheckStateCritical || output.String() != expected {
+				t.Errorf("expected %d with %q, got %d with %q", sensu.CheckStateCritical, expected, status, output.String())
+			}
+			if fmt.Sprint(query.Variables["dagIds"]) != "[etl report]" {
+				t.Errorf("expected the checked DAGs in the query, got %v", query.Variables)
+			}
+			if fmt.Sprint(rest) != fmt.Sprint(tt.rest) {
+				t.Errorf("expected the REST API to retrieve %v, got %v", tt.rest, rest)
+			}
+		})
+	}
+}
+
+func TestCheckDagHealthGraphqlOtherHost(t *testing.T) {
+	tests := []struct {
+		name            string
+		sendCredentials bool
+	}{
+		{"credentials withheld", false},
+		{"credentials sent", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authorization, key string
+			graphql := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization, key = r.Header.Get("Authorization"), r.Header.Get("X-API-Key")
+				fmt.Fprint(w, `{"data": {"dags": [{"dag_id": "etl", "latest_dag_run": {"dag_run_id": "r1", "state": "success"}}]}}`)
+			}))
+			defer graphql.Close()
+
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags": `{"dags": [{"dag_id": "etl"}], "total_entries": 1}`,
+			}))
+			plugin.Dags = []string{"etl"}
+			plugin.GraphqlUrl = graphql.URL + "/graphql"
+			plugin.GraphqlCredentials = tt.sendCredentials
+			plugin.customHeaders = http.Header{"X-Api-Key": []string{"secret"}}
+
+			status, _, err := checkDagHealth(io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != sensu.CheckStateOK {
+				t.Errorf("expected %d, got %d", sensu.CheckStateOK, status)
+			}
+			if sent := authorization != "" || key != ""; sent != tt.sendCredentials {
+				t.Errorf("expected credentials sent %v, got Authorization %q and X-API-Key %q", tt.sendCredentials, authorization, key)
+			}
+			if tt.sendCredentials && (authorization == "" || key != "secret") {
+				t.Errorf("expected credentials and headers, got Authorization %q and X-API-Key %q", authorization, key)
+			}
+		})
+	}
+}
+
+func TestCheckArgsGraphqlUrl(t *testing.T) {
+	saved := plugin
+	defer func() { plugin = saved }()
+
+	plugin.AirflowApiUrl = "http://127.0.0.1:8080/"
+	plugin.ApiVersion = "v1"
+	plugin.AcceptHeader = "application/json"
+	plugin.AirflowUsername = "admin"
+	plugin.AirflowPassword = "admin"
+	plugin.HistoryLimit = 10
+	plugin.FailureThreshold = 1
+
+	plugin.GraphqlUrl = "http://127.0.0.1:8080/graphql"
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin.GraphqlUrl = "127.0.0.1:8080/graphql"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected a warning for a URL without scheme, got %d %v", status, err)
+	}
+
+	plugin.GraphqlUrl = "http://127.0.0.1:8080/graphql"
+	plugin.AirflowApiUrls = []string{"http://127.0.0.1:8080/", "http://127.0.0.1:8081/"}
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected a warning with --urls, got %d %v", status, err)
+	}
+}
+
+func TestCheckDagsWarnCatchup(t *testing.T) {
+	tests := []struct {
+		name     string
+		catchup  bool
+		expected int
+		err      string
+	}{
+		{"catchup enabled", true, sensu.CheckStateWarning, "DAG has catchup enabled: etl"},
+		{"catchup disabled", false, sensu.CheckStateOK, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/details": fmt.Sprintf(`{"dag_id": "etl", "catchup": %v}`, tt.catchup),
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.WarnCatchup = []string{"etl"}
+
+			health, err := checkDags(context.Background(), []string{"etl"}, true, testAPI(http.DefaultClient))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if health[0].Status != tt.expected || fmt.Sprint(health[0].Error) != tt.err {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.err, health[0].Status, health[0].Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagsMinSuccessRate(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/dags/report" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		routes(map[string]string{
+			"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+			"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		}).ServeHTTP(w, r)
+	}))
+
+	transport := &countingTransport{transport: http.DefaultTransport}
+	if _, err := checkDags(context.Background(), []string{"etl", "report"}, true, testAPI(&http.Client{Transport: transport})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the two requests of etl and the failing one of report
+	if transport.calls != 3 || transport.failures != 1 {
+		t.Errorf("expected 3 calls with 1 failure, got %d with %d", transport.calls, transport.failures)
+	}
+	if rate := transport.successRate(); rate != 66 {
+		t.Errorf("expected the share of successful calls, rounded down, got %d%%", rate)
+	}
+}
+
+func TestCountingTransportSuccessRate(t *testing.T) {
+	transport := &countingTransport{}
+	if rate := transport.successRate(); rate != 100 {
+		t.Errorf("expected 100%% without any call, got %d%%", rate)
+	}
+
+	transport = &countingTransport{calls: 3, failures: 1}
+	if rate := transport.successRate(); rate != 66 {
+		t.Errorf("expected the share of successful calls, rounded down, got %d%%", rate)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer server.Close()
+
+	// a 4xx answer like a missing DAG is a success of the API
+	transport = &countingTransport{transport: http.DefaultTransport}
+	client := &http.Client{Transport: transport}
+	for _, u := range []string{server.URL + "/ok", server.URL + "/missing", server.URL + "/error", server.URL + "/limited", closed.URL} {
+		if resp, err := client.Get(u); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if transport.calls != 5 || transport.failures != 3 {
+		t.Errorf("expected 3 failures out of 5 calls, got %d out of %d", transport.failures, transport.calls)
+	}
+}
+
+func TestCheckDagsWaitCompletion(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitTimeout int
+		states      []string
+		expected    int
+		err         string
+	}{
+		{"run completes", 3, []string{"running", "success"}, sensu.CheckStateOK, "<nil>"},
+		{"run fails", 3, []string{"running", "failed"}, sensu.CheckStateCritical, "DAG failed its last execution: etl run r1"},
+		{"wait times out", 1, []string{"running", "running"}, sensu.CheckStateUnknown, "timed out waiting for DAG run to complete: etl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls := 0
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/v1/dags/etl/dagRuns" {
+					state := tt.states[len(tt.states)-1]
+					if polls < len(tt.states) {
+						state = tt.states[polls]
+					}
+					polls++
+					fmt.Fprintf(w, `{"dag_runs": [{"dag_run_id": "r1", "state": "%s"}], "total_entries": 1}`, state)
+					return
+				}
+				routes(map[string]string{
+					"/api/v1/dags/etl": `{"dag_id": "etl"}`,
+				}).ServeHTTP(w, r)
+			}))
+			plugin.WaitCompletion = true
+			plugin.WaitTimeout = tt.waitTimeout
+			plugin.PollInterval = 1
+
+			health, err := checkDags(context.Background(), []string{"etl"}, true, testAPI(http.DefaultClient))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if health[0].Status != tt.expected || fmt.Sprint(health[0].Error) != tt.err {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.err, health[0].Status, health[0].Error)
+			}
+			if polls != len(tt.states) {
+				t.Errorf("expected the run to be retrieved %d times, got %d", len(tt.states), polls)
+			}
+		})
+	}
+}
+
+func TestCheckDagRequiredTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     string
+		expected int
+		err      string
+	}{
+		{"tag missing", `[{"name": "owner"}]`, sensu.CheckStateWarning, "DAG is missing required tags: etl (tier)"},
+		{"all tags missing", `[]`, sensu.CheckStateWarning, "DAG is missing required tags: etl (owner, tier)"},
+		{"tags present", `[{"name": "tier"}, {"name": "owner"}, {"name": "etl"}]`, sensu.CheckStateOK, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         fmt.Sprintf(`{"dag_id": "etl", "tags": %s}`, tt.tags),
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+			}))
+			plugin.RequiredTags = []string{"owner", "tier"}
+
+			health := checkDag(context.Background(), "etl", false, testAPI(http.DefaultClient))
+			if health.Status != tt.expected || fmt.Sprint(health.Error) != tt.err {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.err, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagsPerDagTimeout(t *testing.T) {
+	useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/dags/slow/dagRuns" {
+			// answers only once the DAG check gave up
+			select {
+			case <-r.Context().Done():
+			case <-time.After(3 * time.Second):
+			}
+			return
+		}
+		routes(map[string]string{
+			"/api/v1/dags/slow":        `{"dag_id": "slow"}`,
+			"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+			"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "success"}], "total_entries": 1}`,
+		}).ServeHTTP(w, r)
+	}))
+	plugin.PerDagTimeout = 1
+
+	start := time.Now()
+	health, err := checkDags(context.Background(), []string{"slow", "etl"}, true, testAPI(http.DefaultClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the slow DAG to be given up after a second, took %s", elapsed)
+	}
+
+	// the slow DAG is unknown, the next one is still checked
+	if health[0].Status != sensu.CheckStateUnknown || fmt.Sprint(health[0].Error) != "check timed out for this DAG: slow" {
+		t.Errorf("expected the slow DAG to time out, got %d with %q", health[0].Status, health[0].Error)
+	}
+	if health[1].Status != sensu.CheckStateOK {
+		t.Errorf("expected etl to be checked, got %d with %q", health[1].Status, health[1].Error)
+	}
+}
+
+func TestCheckDagsWarnNoRuns(t *testing.T) {
+	tests := []struct {
+		name       string
+		warnNoRuns bool
+		expected   int
+		err        string
+	}{
+		{"enabled", true, sensu.CheckStateWarning, "DAG is active but has never run: etl"},
+		{"disabled", false, sensu.CheckStateOK, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, routes(map[string]string{
+				"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+				"/api/v1/dags/etl/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+				"/api/v1/dags/old":         `{"dag_id": "old", "is_paused": true}`,
+				"/api/v1/dags/old/dagRuns": `{"dag_runs": [], "total_entries": 0}`,
+			}))
+			plugin.WarnNoRuns = tt.warnNoRuns
+
+			// the paused DAG that never ran is left alone
+			health, err := checkDags(context.Background(), []string{"etl", "old"}, false, testAPI(http.DefaultClient))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if health[0].Status != tt.expected || fmt.Sprint(health[0].Error) != tt.err {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.err, health[0].Status, health[0].Error)
+			}
+			if health[1].Status != sensu.CheckStateOK {
+				t.Errorf("expected the paused DAG to be left alone, got %d with %q", health[1].Status, health[1].Error)
+			}
+		})
+	}
+}
+
+func TestPrintHeartbeat(t *testing.T) {
+	var output bytes.Buffer
+	printHeartbeat(&output)
+
+	heartbeat := regexp.MustCompile(`^airflow-dag-check heartbeat ok at \d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z\n$`)
+	if !heartbeat.MatchString(output.String()) {
+		t.Errorf("unexpected heartbeat: %q", output.String())
+	}
+}
+
+func TestCheckDagCheckZombies(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  string
+		expected int
+		err      string
+	}{
+		{"zombie tasks", `{"task_instances": [{"task_id": "extract", "state": "running"}, {"task_id": "load", "state": "running"}], "total_entries": 2}`,
+			sensu.CheckStateWarning, "DAG run ended with 2 tasks still running: etl r1 (extract, load)"},
+		{"no zombie task", `{"task_instances": [], "total_entries": 0}`, sensu.CheckStateOK, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/v1/dags/etl/dagRuns/r1/taskInstances" {
+					if state := r.URL.Query()["state"]; len(state) != 1 || state[0] != "running" {
+						t.Errorf("expected the running tasks to be listed, got %s", r.URL.RawQuery)
+					}
+					fmt.Fprint(w, tt.running)
+					return
+				}
+				routes(map[string]string{
+					"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+					"/api/v1/dags/etl/dagRuns": fmt.Sprintf(`{"dag_runs": [{"dag_run_id": "r1", "state": "success", "end_date": "%s"}], "total_entries": 1}`, time.Now().UTC().Format(time.RFC3339)),
+				}).ServeHTTP(w, r)
+			}))
+			plugin.CheckZombies = true
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected || fmt.Sprint(health.Error) != tt.err {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.err, health.Status, health.Error)
+			}
+		})
+	}
+}
+
+func TestCheckDagMaxTaskQueuedAge(t *testing.T) {
+	tests := []struct {
+		name     string
+		queued   time.Duration
+		expected int
+		err      string
+	}{
+		{"queued too long", 2 * time.Hour, sensu.CheckStateWarning, "DAG run has tasks queued for longer than 1h0m0s: etl r1 (load)"},
+		{"queued recently", time.Minute, sensu.CheckStateOK, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queuedWhen := time.Now().Add(-tt.queued).UTC().Format(time.RFC3339)
+			useServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/v1/dags/etl/dagRuns/r1/taskInstances" {
+					if state := r.URL.Query()["state"]; len(state) != 1 || state[0] != "queued" {
+						t.Errorf("expected the queued tasks to be listed, got %s", r.URL.RawQuery)
+					}
+					fmt.Fprintf(w, `{"task_instances": [{"task_id": "load", "state": "queued", "queued_when": "%s"}], "total_entries": 1}`, queuedWhen)
+					return
+				}
+				routes(map[string]string{
+					"/api/v1/dags/etl":         `{"dag_id": "etl"}`,
+					"/api/v1/dags/etl/dagRuns": `{"dag_runs": [{"dag_run_id": "r1", "state": "running"}], "total_entries": 1}`,
+				}).ServeHTTP(w, r)
+			}))
+			plugin.MaxTaskQueuedAge = 3600
+
+			health := checkDag(context.Background(), "etl", true, testAPI(http.DefaultClient))
+			if health.Status != tt.expected || fmt.Sprint(health.Error) != tt.err {
+				t.Errorf("expected %d with %q, got %d with %q", tt.expected, tt.err, health.Status, health.Error)
+			}
+		})
+	}
+}